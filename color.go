@@ -0,0 +1,61 @@
+package main
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/paulvasilenko/go-transcolor"
+)
+
+// isDeep reports whether img carries more than 8 bits per channel.
+func isDeep(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// transferColor adjusts the colors of target to the Lab statistics of src,
+// like transcolor.Transfer. With deep set the result keeps 16 bits per
+// channel instead of being rounded to 8.
+func transferColor(src, target image.Image, deep bool) image.Image {
+	if !deep {
+		return transcolor.Transfer(src, target)
+	}
+
+	srcStat := transcolor.ImageToLab(src).Stat()
+	targetLab := transcolor.ImageToLab(target)
+	targetStat := targetLab.Stat()
+
+	shift := func(v float64, from, to transcolor.Stat) float64 {
+		if from.StdDev == 0 {
+			return v - from.Mean + to.Mean
+		}
+		return (v-from.Mean)*(to.StdDev/from.StdDev) + to.Mean
+	}
+
+	b := target.Bounds()
+	out := image.NewNRGBA64(b)
+	i := 0
+	// ImageToLab walks the image column by column.
+	for x := b.Min.X; x < b.Max.X; x++ {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			c := colorful.Lab(
+				shift(targetLab.Pix[i], targetStat.LStat, srcStat.LStat),
+				shift(targetLab.Pix[i+1], targetStat.AStat, srcStat.AStat),
+				shift(targetLab.Pix[i+2], targetStat.BStat, srcStat.BStat),
+			).Clamped()
+			_, _, _, a := target.At(x, y).RGBA()
+			out.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(c.R*0xffff + 0.5),
+				G: uint16(c.G*0xffff + 0.5),
+				B: uint16(c.B*0xffff + 0.5),
+				A: uint16(a),
+			})
+			i += 3
+		}
+	}
+	return out
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"io"
+)
+
+// sideBySide places before and after next to each other, or after below
+// before when vertical.
+func sideBySide(before, after image.Image, vertical bool) image.Image {
+	bb, ab := before.Bounds(), after.Bounds()
+	offset := image.Pt(bb.Dx(), 0)
+	size := image.Pt(bb.Dx()+ab.Dx(), bb.Dy())
+	if ab.Dy() > size.Y {
+		size.Y = ab.Dy()
+	}
+	if vertical {
+		offset = image.Pt(0, bb.Dy())
+		size = image.Pt(bb.Dx(), bb.Dy()+ab.Dy())
+		if ab.Dx() > size.X {
+			size.X = ab.Dx()
+		}
+	}
+	r := image.Rectangle{Max: size}
+	var out draw.Image = image.NewRGBA(r)
+	if isDeep(before) || isDeep(after) {
+		out = image.NewRGBA64(r)
+	}
+	draw.Draw(out, bb.Sub(bb.Min), before, bb.Min, draw.Src)
+	draw.Draw(out, ab.Sub(ab.Min).Add(offset), after, ab.Min, draw.Src)
+	return out
+}
+
+// flipbook returns a two frame animation alternating between before and
+// after, a second each.
+func flipbook(before, after image.Image) *gif.GIF {
+	b := after.Bounds()
+	src := &gif.GIF{
+		Delay:  []int{100, 100},
+		Config: image.Config{Width: b.Dx(), Height: b.Dy()},
+	}
+	return encodeAnimation([]image.Image{before, after}, src)
+}
+
+var compareHTML = template.Must(template.New("compare").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Before and after</title>
+<style>
+body { margin: 0; background: #222; }
+#compare { position: relative; display: inline-block; cursor: ew-resize; user-select: none; touch-action: none; }
+#compare img { display: block; max-width: 100vw; }
+#before { position: absolute; top: 0; left: 0; clip-path: inset(0 50% 0 0); }
+#handle { position: absolute; top: 0; bottom: 0; left: 50%; width: 2px; margin-left: -1px; background: #fff; }
+</style>
+</head>
+<body>
+<div id="compare">
+<img id="after" src="{{.After}}" alt="After" draggable="false">
+<img id="before" src="{{.Before}}" alt="Before" draggable="false">
+<div id="handle"></div>
+</div>
+<script>
+var compare = document.getElementById("compare");
+var before = document.getElementById("before");
+var handle = document.getElementById("handle");
+var dragging = false;
+function split(e) {
+	var r = compare.getBoundingClientRect();
+	var p = Math.min(Math.max((e.clientX - r.left) / r.width, 0), 1) * 100;
+	before.style.clipPath = "inset(0 " + (100 - p) + "% 0 0)";
+	handle.style.left = p + "%";
+}
+compare.addEventListener("pointerdown", function(e) { dragging = true; compare.setPointerCapture(e.pointerId); split(e); });
+compare.addEventListener("pointermove", function(e) { if (dragging) split(e); });
+compare.addEventListener("pointerup", function() { dragging = false; });
+</script>
+</body>
+</html>
+`))
+
+// dataURI encodes img as a JPEG data URI.
+func dataURI(img image.Image, quality int) (template.URL, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: quality}); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// flatten composites img over white, JPEG has no alpha.
+func flatten(img image.Image) image.Image {
+	if opaque(img) {
+		return img
+	}
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(out, b, img, b.Min, draw.Over)
+	return out
+}
+
+// writeCompareHTML writes a page showing after with before on top of it,
+// split at a handle that can be dragged across the image. Both images are
+// embedded, so the page can be shared as a single file.
+func writeCompareHTML(w io.Writer, before, after image.Image, quality int) error {
+	b, err := dataURI(before, quality)
+	if err != nil {
+		return err
+	}
+	a, err := dataURI(after, quality)
+	if err != nil {
+		return err
+	}
+	return compareHTML.Execute(w, struct{ Before, After template.URL }{b, a})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// headRect scales rect by scale while keeping its bottom edge, the chin,
+// in place and the face horizontally centered.
+func headRect(rect image.Rectangle, scale float64) image.Rectangle {
+	if scale <= 0 || scale == 1 {
+		return rect
+	}
+	w := int(float64(rect.Dx()) * scale)
+	h := int(float64(rect.Dy()) * scale)
+	cx := rect.Min.X + rect.Dx()/2
+	return image.Rect(cx-w/2, rect.Max.Y-h, cx-w/2+w, rect.Max.Y)
+}
+
+// placement is a single face to be pasted: sample is the detected face
+// region used for color statistics, rect is where the new face is drawn.
+// mask, in canvas coordinates, limits the pixels the face may cover; a nil
+// mask covers the whole rect. annotation is the Vision detection being
+// replaced, if any, and index its position in the detection list.
+type placement struct {
+	index      int
+	sample     image.Rectangle
+	rect       image.Rectangle
+	face       image.Image
+	mask       *image.Alpha
+	annotation *pb.FaceAnnotation
+}
+
+// compositeOptions controls how faces are blended into the photo.
+type compositeOptions struct {
+	// matchQuality degrades pasted faces to the blur, noise and
+	// resolution of the region they replace.
+	matchQuality bool
+	// adaptLikelihoods blurs or darkens pasted faces when Vision reports
+	// the original face as blurred or under-exposed.
+	adaptLikelihoods bool
+	// preserveOcclusions keeps hats and glasses of the original face on
+	// top of the pasted one.
+	preserveOcclusions bool
+	// linear resizes and blends in linear light instead of directly on
+	// the sRGB encoded values.
+	linear bool
+	// colorTransfer matches the colors of pasted faces to the faces they
+	// replace.
+	colorTransfer bool
+}
+
+// pasteFace color matches face against the sample region of base, resizes
+// it to rect and draws it onto canvas. rect may extend past the canvas, in
+// which case the face is clipped at the image edge. It returns the face as
+// drawn, see faceLayer.
+func pasteFace(canvas draw.Image, base canvasImage, p placement, opts compositeOptions) *image.NRGBA {
+	if p.rect.Empty() {
+		return nil
+	}
+	deep := isDeep(base)
+	resized := resizeImage(p.face, p.rect.Dx(), p.rect.Dy(), opts.linear)
+	var src image.Image = resized
+	if opts.adaptLikelihoods {
+		src = blurToAnnotation(src, p.annotation, deep)
+		src = exposeToAnnotation(src, p.annotation, deep)
+	}
+	sample := p.sample.Intersect(base.Bounds())
+	if !sample.Empty() && opts.colorTransfer {
+		src = transferColor(base.SubImage(sample), src, deep)
+	}
+	if !sample.Empty() && opts.matchQuality {
+		src = matchQuality(src, analyzeQuality(base, sample), deep)
+	}
+	var mask image.Image
+	if p.mask != nil {
+		mask = p.mask
+	}
+	drawOver(canvas, p.rect, src, src.Bounds().Min, mask, p.rect.Min, opts.linear)
+	var occluded *image.Alpha
+	if opts.preserveOcclusions {
+		occluded = restoreOcclusions(canvas, base, p, opts.linear)
+	}
+	return faceLayer(p.rect.Intersect(canvas.Bounds()), src, src.Bounds().Min.Sub(p.rect.Min), p.mask, occluded)
+}
+
+// faceLayer cuts the part of src drawn at r, offset by delta from canvas
+// to src coordinates, into an image of its own. Its alpha is the coverage
+// the face ended up with: the face's own alpha, limited to mask and minus
+// the occluded pixels restored from the photo. Either mask may be nil.
+func faceLayer(r image.Rectangle, src image.Image, delta image.Point, mask, occluded *image.Alpha) *image.NRGBA {
+	layer := image.NewNRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := color.NRGBAModel.Convert(src.At(x+delta.X, y+delta.Y)).(color.NRGBA)
+			a := uint32(c.A)
+			if mask != nil {
+				a = a * uint32(mask.AlphaAt(x, y).A) / 0xff
+			}
+			if occluded != nil {
+				a = a * uint32(0xff-occluded.AlphaAt(x, y).A) / 0xff
+			}
+			c.A = uint8(a)
+			layer.SetNRGBA(x, y, c)
+		}
+	}
+	return layer
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+var (
+	debugBoxColor      = color.RGBA{0x00, 0xff, 0x00, 0xff}
+	debugFaceBoxColor  = color.RGBA{0xff, 0xd0, 0x00, 0xff}
+	debugLandmarkColor = color.RGBA{0xff, 0x30, 0x30, 0xff}
+	debugTextColor     = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	debugLabelBack     = color.RGBA{0x00, 0x00, 0x00, 0xa0}
+)
+
+// debugFont is the face of all text drawn on debug images and sheets.
+var debugFont = basicfont.Face7x13
+
+// textSize returns the size of s drawn at scale.
+func textSize(s string, scale int) image.Point {
+	if s == "" {
+		return image.Point{}
+	}
+	w := font.MeasureString(debugFont, s).Ceil()
+	return image.Pt(w*scale, debugFont.Metrics().Height.Ceil()*scale)
+}
+
+// drawText draws s with its top left corner at pt, every font pixel
+// scale pixels wide. Characters the font lacks show as a replacement
+// glyph.
+func drawText(img draw.Image, pt image.Point, s string, scale int, c color.Color) {
+	size := textSize(s, 1)
+	if size == (image.Point{}) {
+		return
+	}
+	mask := image.NewAlpha(image.Rectangle{Max: size})
+	d := &font.Drawer{
+		Dst:  mask,
+		Src:  image.Opaque,
+		Face: debugFont,
+		Dot:  fixed.P(0, debugFont.Metrics().Ascent.Ceil()),
+	}
+	d.DrawString(s)
+
+	src := image.NewUniform(c)
+	if scale <= 1 {
+		draw.DrawMask(img, mask.Bounds().Add(pt), src, image.Point{}, mask, image.Point{}, draw.Over)
+		return
+	}
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			a := mask.AlphaAt(x, y)
+			if a.A == 0 {
+				continue
+			}
+			r := image.Rect(0, 0, scale, scale).Add(pt.Add(image.Pt(x*scale, y*scale)))
+			draw.DrawMask(img, r, src, image.Point{}, image.NewUniform(a), image.Point{}, draw.Over)
+		}
+	}
+}
+
+// drawLabel draws lines of text on a translucent background so they stay
+// readable on any photo, keeping them inside the image where possible.
+func drawLabel(img draw.Image, pt image.Point, lines []string, scale int) {
+	var size image.Point
+	for _, l := range lines {
+		s := textSize(l, scale)
+		if s.X > size.X {
+			size.X = s.X
+		}
+		size.Y += s.Y + 2*scale
+	}
+	pad := scale
+	r := image.Rectangle{pt, pt.Add(size).Add(image.Pt(2*pad, 2*pad))}
+	b := img.Bounds()
+	if r.Max.X > b.Max.X {
+		r = r.Sub(image.Pt(r.Max.X-b.Max.X, 0))
+	}
+	if r.Max.Y > b.Max.Y {
+		r = r.Sub(image.Pt(0, r.Max.Y-b.Max.Y))
+	}
+	if r.Min.X < b.Min.X {
+		r = r.Add(image.Pt(b.Min.X-r.Min.X, 0))
+	}
+	if r.Min.Y < b.Min.Y {
+		r = r.Add(image.Pt(0, b.Min.Y-r.Min.Y))
+	}
+	draw.Draw(img, r, image.NewUniform(debugLabelBack), image.Point{}, draw.Over)
+	y := r.Min.Y + pad
+	for _, l := range lines {
+		drawText(img, image.Pt(r.Min.X+pad, y), l, scale, debugTextColor)
+		y += textSize(l, scale).Y + 2*scale
+	}
+}
+
+// drawLine draws a line width pixels thick from a to b.
+func drawLine(img draw.Image, a, b image.Point, width int, c color.Color) {
+	src := image.NewUniform(c)
+	dx, dy := b.X-a.X, b.Y-a.Y
+	steps := dx
+	if steps < 0 {
+		steps = -steps
+	}
+	if dy > steps || -dy > steps {
+		steps = dy
+		if steps < 0 {
+			steps = -steps
+		}
+	}
+	if steps == 0 {
+		steps = 1
+	}
+	for i := 0; i <= steps; i++ {
+		x := a.X + dx*i/steps
+		y := a.Y + dy*i/steps
+		r := image.Rect(x-width/2, y-width/2, x-width/2+width, y-width/2+width)
+		draw.Draw(img, r, src, image.Point{}, draw.Src)
+	}
+}
+
+// drawPoly outlines a bounding poly.
+func drawPoly(img draw.Image, poly *pb.BoundingPoly, width int, c color.Color) {
+	if poly == nil {
+		return
+	}
+	vs := poly.Vertices
+	for i := range vs {
+		a, b := vs[i], vs[(i+1)%len(vs)]
+		drawLine(img, image.Pt(int(a.X), int(a.Y)), image.Pt(int(b.X), int(b.Y)), width, c)
+	}
+}
+
+// drawDebugOverlay draws what detection and assignment saw onto img: the
+// head box in green, the tight face box in yellow, every landmark with its
+// name, and a label with the assigned library file, the detection
+// confidence and the head angles. names[i] is the library file that
+// replaced faces[i].
+func drawDebugOverlay(img draw.Image, faces []*pb.FaceAnnotation, names []string) {
+	b := img.Bounds()
+	scale := b.Dx() / 500
+	if b.Dy() < b.Dx() {
+		scale = b.Dy() / 500
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	for i, face := range faces {
+		drawPoly(img, face.BoundingPoly, scale, debugBoxColor)
+		drawPoly(img, face.FdBoundingPoly, scale, debugFaceBoxColor)
+		for _, lm := range face.Landmarks {
+			if lm.Position == nil {
+				continue
+			}
+			p := image.Pt(int(lm.Position.X), int(lm.Position.Y))
+			dot := image.Rect(-scale, -scale, scale+1, scale+1).Add(p)
+			draw.Draw(img, dot, image.NewUniform(debugLandmarkColor), image.Point{}, draw.Src)
+			name := strings.ToLower(lm.Type.String())
+			drawText(img, p.Add(image.Pt(2*scale, -textSize(name, scale).Y/2)), name, scale, debugLandmarkColor)
+		}
+
+		lines := []string{
+			fmt.Sprintf("#%d %s", i+1, names[i]),
+			fmt.Sprintf("confidence %.2f", face.DetectionConfidence),
+			fmt.Sprintf("roll %.1f pan %.1f tilt %.1f", face.RollAngle, face.PanAngle, face.TiltAngle),
+		}
+		r := polyRect(face.BoundingPoly)
+		drawLabel(img, image.Pt(r.Min.X, r.Max.Y+scale), lines, scale)
+	}
+}
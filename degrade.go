@@ -0,0 +1,237 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+
+	"github.com/disintegration/imaging"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// quality describes how clean a region of an image is.
+// sharpness is the variance of the Laplacian with the contribution of the
+// noise removed, noise is the estimated standard deviation of the sensor
+// noise in 8-bit levels and resolution is the fraction of the pixel
+// resolution that actually carries detail.
+type quality struct {
+	sharpness  float64
+	noise      float64
+	resolution float64
+}
+
+// luma returns the 8-bit luma values of r in img, row by row.
+func luma(img image.Image, r image.Rectangle) []float64 {
+	r = r.Intersect(img.Bounds())
+	l := make([]float64, 0, r.Dx()*r.Dy())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c, _, _, _ := color.GrayModel.Convert(img.At(x, y)).RGBA()
+			l = append(l, float64(c>>8))
+		}
+	}
+	return l
+}
+
+// laplacianVariance returns the variance of the 4-neighbour Laplacian of a
+// w×h luma plane.
+func laplacianVariance(l []float64, w, h int) float64 {
+	if w < 3 || h < 3 {
+		return 0
+	}
+	var sum, sq float64
+	n := 0
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			v := l[i-w] + l[i+w] + l[i-1] + l[i+1] - 4*l[i]
+			sum += v
+			sq += v * v
+			n++
+		}
+	}
+	mean := sum / float64(n)
+	return sq/float64(n) - mean*mean
+}
+
+// noiseSigma estimates the noise standard deviation of a w×h luma plane
+// using Immerkær's fast noise variance estimation.
+func noiseSigma(l []float64, w, h int) float64 {
+	if w < 3 || h < 3 {
+		return 0
+	}
+	var sum float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			v := l[i-w-1] - 2*l[i-w] + l[i-w+1] -
+				2*l[i-1] + 4*l[i] - 2*l[i+1] +
+				l[i+w-1] - 2*l[i+w] + l[i+w+1]
+			sum += math.Abs(v)
+		}
+	}
+	return sum * math.Sqrt(math.Pi/2) / (6 * float64(w-2) * float64(h-2))
+}
+
+// detail returns the Laplacian variance of a w×h luma plane that is due to
+// image content rather than noise. White noise of standard deviation σ adds
+// 20σ² to the variance of the 4-neighbour Laplacian.
+func detail(l []float64, w, h int) float64 {
+	n := noiseSigma(l, w, h)
+	return math.Max(0, laplacianVariance(l, w, h)-20*n*n)
+}
+
+// analyzeQuality measures the quality of r in img.
+func analyzeQuality(img image.Image, r image.Rectangle) quality {
+	r = r.Intersect(img.Bounds())
+	w, h := r.Dx(), r.Dy()
+	l := luma(img, r)
+	q := quality{
+		sharpness:  detail(l, w, h),
+		noise:      noiseSigma(l, w, h),
+		resolution: 1,
+	}
+	if q.sharpness == 0 {
+		return q
+	}
+
+	// The effective resolution is the smallest scale the region can be
+	// taken down to and back up again without losing most of its detail.
+	region := imaging.Crop(img, r)
+	for _, scale := range []float64{0.75, 0.5, 0.35, 0.25} {
+		sw, sh := int(float64(w)*scale), int(float64(h)*scale)
+		if sw < 3 || sh < 3 {
+			break
+		}
+		round := imaging.Resize(imaging.Resize(region, sw, sh, imaging.Box), w, h, imaging.Linear)
+		if detail(luma(round, round.Bounds()), w, h) < q.sharpness*0.8 {
+			break
+		}
+		q.resolution = scale
+	}
+	return q
+}
+
+// blurImage is imaging.Blur, keeping 16 bits per channel when deep.
+func blurImage(img image.Image, sigma float64, deep bool) image.Image {
+	if !deep {
+		return imaging.Blur(img, sigma)
+	}
+	return blurLinear(toSamples(img), sigma).samples()
+}
+
+// matchQuality degrades img, the face about to be pasted, so that its
+// resolution, sharpness and grain are no better than target. With deep set
+// the result keeps 16 bits per channel.
+func matchQuality(img image.Image, target quality, deep bool) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w < 3 || h < 3 {
+		return img
+	}
+	out := img
+
+	if target.resolution < 1 {
+		sw, sh := int(float64(w)*target.resolution), int(float64(h)*target.resolution)
+		if sw > 0 && sh > 0 {
+			if deep {
+				out = resizeLinear(resizeLinear(toSamples(out), sw, sh), w, h).samples()
+			} else {
+				out = imaging.Resize(imaging.Resize(out, sw, sh, imaging.Box), w, h, imaging.Linear)
+			}
+		}
+	}
+
+	if detail(luma(out, out.Bounds()), w, h) > target.sharpness {
+		for sigma := 0.5; sigma <= 4; sigma += 0.5 {
+			blurred := blurImage(out, sigma, deep)
+			if detail(luma(blurred, blurred.Bounds()), w, h) <= target.sharpness || sigma == 4 {
+				out = blurred
+				break
+			}
+		}
+	}
+
+	// Independent noise adds in quadrature, so only top up the difference.
+	current := noiseSigma(luma(out, out.Bounds()), w, h)
+	if grain := math.Sqrt(math.Max(0, target.noise*target.noise-current*current)); grain > 0.5 {
+		out = addGrain(out, grain, deep)
+	}
+	return out
+}
+
+// addGrain returns img with monochrome gaussian noise of the given standard
+// deviation, in 8-bit levels, added to it, leaving alpha untouched.
+func addGrain(img image.Image, sigma float64, deep bool) image.Image {
+	if !deep {
+		out := imaging.Clone(img)
+		for i := 0; i+3 < len(out.Pix); i += 4 {
+			n := rand.NormFloat64() * sigma
+			for c := 0; c < 3; c++ {
+				v := float64(out.Pix[i+c]) + n
+				out.Pix[i+c] = uint8(math.Max(0, math.Min(255, v+0.5)))
+			}
+		}
+		return out
+	}
+	out := toSamples(img).samples()
+	for i := 0; i+7 < len(out.Pix); i += 8 {
+		n := rand.NormFloat64() * sigma * 0x101
+		for c := 0; c < 6; c += 2 {
+			v := float64(uint16(out.Pix[i+c])<<8|uint16(out.Pix[i+c+1])) + n
+			u := uint16(math.Max(0, math.Min(0xffff, v+0.5)))
+			out.Pix[i+c], out.Pix[i+c+1] = uint8(u>>8), uint8(u)
+		}
+	}
+	return out
+}
+
+// likely reports whether Vision considers l at least likely.
+func likely(l pb.Likelihood) bool {
+	return l >= pb.Likelihood_LIKELY
+}
+
+// strength is how strongly to adapt to a likely or very likely finding.
+func strength(l pb.Likelihood) float64 {
+	if l == pb.Likelihood_VERY_LIKELY {
+		return 2
+	}
+	return 1
+}
+
+// blurToAnnotation blurs img, the resized library face, when Vision
+// reports the face it replaces as blurred.
+func blurToAnnotation(img image.Image, face *pb.FaceAnnotation, deep bool) image.Image {
+	if face == nil || !likely(face.BlurredLikelihood) {
+		return img
+	}
+	sigma := float64(img.Bounds().Dx()) / 100 * strength(face.BlurredLikelihood)
+	return blurImage(img, math.Max(sigma, 1), deep)
+}
+
+// exposeToAnnotation darkens img, the resized library face, when Vision
+// reports the face it replaces as under-exposed. It runs before color
+// transfer: the transfer matches the face to the original's lightness,
+// which is already dark, and keeps the crushed shadows of the gamma curve.
+func exposeToAnnotation(img image.Image, face *pb.FaceAnnotation, deep bool) image.Image {
+	if face == nil || !likely(face.UnderExposedLikelihood) {
+		return img
+	}
+	s := strength(face.UnderExposedLikelihood)
+	brightness, gamma := -15*s, 1-0.2*s
+	if !deep {
+		return imaging.AdjustGamma(imaging.AdjustBrightness(img, brightness), gamma)
+	}
+	// The same curve as imaging.AdjustBrightness and AdjustGamma.
+	out := toSamples(img).samples()
+	for i := 0; i+7 < len(out.Pix); i += 8 {
+		for c := 0; c < 6; c += 2 {
+			v := float64(uint16(out.Pix[i+c])<<8|uint16(out.Pix[i+c+1])) / 0xffff
+			v = math.Pow(math.Max(0, math.Min(1, v+brightness/100)), 1/gamma)
+			u := uint16(v*0xffff + 0.5)
+			out.Pix[i+c], out.Pix[i+c+1] = uint8(u>>8), uint8(u)
+		}
+	}
+	return out
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/vision/apiv1"
+	"golang.org/x/net/context"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+const (
+	tagStripOffsets = 0x0111
+	tagTileOffsets  = 0x0144
+)
+
+// isPDF reports whether data is a PDF document.
+func isPDF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("%PDF-"))
+}
+
+// tiffPages returns the offsets of the IFDs of a TIFF file, one per page.
+func tiffPages(data []byte) []uint32 {
+	var pages []uint32
+	seen := map[uint32]bool{}
+	for offset := tiffFirstIFD(data); offset != 0 && !seen[offset]; {
+		seen[offset] = true
+		entries, next := tiffIFD(data, offset)
+		if entries == nil {
+			break
+		}
+		pages = append(pages, offset)
+		offset = next
+	}
+	return pages
+}
+
+// tiffPage returns a copy of a TIFF file whose first IFD is the one at
+// offset, so that single image decoders read that page.
+func tiffPage(data []byte, offset uint32) []byte {
+	page := append([]byte(nil), data...)
+	tiffByteOrder(page).PutUint32(page[4:], offset)
+	return page
+}
+
+// decodeTIFFPages decodes every page of a TIFF file, turned upright. It
+// also returns the metadata of the first page.
+func decodeTIFFPages(data []byte) ([]image.Image, metadata, error) {
+	var pages []image.Image
+	var first metadata
+	for i, offset := range tiffPages(data) {
+		img, _, m, err := decodeImage(tiffPage(data, offset))
+		if err != nil {
+			return nil, metadata{}, fmt.Errorf("page %d: %s", i+1, err)
+		}
+		if i == 0 {
+			first = m
+		}
+		pages = append(pages, img)
+	}
+	return pages, first, nil
+}
+
+// encodeTIFFPages writes pages as a single multi-page TIFF. Every page is
+// encoded on its own and then appended to the file, moving the offsets in
+// its IFD along with it.
+func encodeTIFFPages(pages []image.Image) ([]byte, error) {
+	var out []byte
+	var prevNext int
+	for i, img := range pages {
+		var buf bytes.Buffer
+		if err := encodeFormat(&buf, img, encodeOptions{format: "tiff"}); err != nil {
+			return nil, err
+		}
+		page := buf.Bytes()
+		order := tiffByteOrder(page)
+		ifd := tiffFirstIFD(page)
+		entries, _ := tiffIFD(page, ifd)
+		if entries == nil {
+			return nil, fmt.Errorf("page %d: bad TIFF", i+1)
+		}
+
+		// The page keeps its position relative to the end of the header.
+		shift := uint32(0)
+		if i == 0 {
+			out = append(out, page...)
+		} else {
+			shift = uint32(len(out) - 8)
+			out = append(out, page[8:]...)
+		}
+		for _, e := range entries {
+			// The value field follows the tag, type and count.
+			pos := e.pos + 8 + int(shift)
+			if e.size() > 4 {
+				order.PutUint32(out[pos:], order.Uint32(e.value)+shift)
+			}
+			if e.tag != tagStripOffsets && e.tag != tagTileOffsets {
+				continue
+			}
+			values := pos
+			if e.size() > 4 {
+				values = int(order.Uint32(e.value) + shift)
+			}
+			for n := 0; n < int(e.count); n++ {
+				switch e.typ {
+				case 3:
+					p := out[values+n*2:]
+					order.PutUint16(p, order.Uint16(p)+uint16(shift))
+				case 4:
+					p := out[values+n*4:]
+					order.PutUint32(p, order.Uint32(p)+shift)
+				}
+			}
+		}
+		if i > 0 {
+			order.PutUint32(out[prevNext:], ifd+shift)
+		}
+		prevNext = int(ifd+shift) + 2 + len(entries)*12
+	}
+	return out, nil
+}
+
+// chrisifyDocument replaces the faces on every page of a document. Pages
+// are unrelated photos, so each gets its own assignment. detected holds
+// the faces of every page, see detectDocument; when it is nil each page
+// is sent to Vision on its own.
+func chrisifyDocument(ctx context.Context, client *vision.ImageAnnotatorClient, pages []image.Image, detected [][]*pb.FaceAnnotation, library FaceList, opts renderOptions) ([]image.Image, error) {
+	out := make([]image.Image, len(pages))
+	for i, page := range pages {
+		var faces []*pb.FaceAnnotation
+		if detected != nil {
+			faces = detected[i]
+		} else {
+			var err error
+			faces, err = detectImage(ctx, client, page)
+			if err != nil {
+				return nil, fmt.Errorf("page %d: %s", i+1, err)
+			}
+		}
+		faces = suppressDuplicates(faces, opts.nms)
+		out[i] = render(page, faces, library, randomAssignment(len(faces), library), opts)
+	}
+	return out, nil
+}
+
+// jsonPoly is a bounding poly in the JSON form Vision writes file
+// annotation results in.
+type jsonPoly struct {
+	Vertices []struct {
+		X, Y int32
+	}
+}
+
+func (p jsonPoly) poly() *pb.BoundingPoly {
+	poly := &pb.BoundingPoly{}
+	for _, v := range p.Vertices {
+		poly.Vertices = append(poly.Vertices, &pb.Vertex{X: v.X, Y: v.Y})
+	}
+	return poly
+}
+
+// jsonFace is a face annotation in the JSON form Vision writes file
+// annotation results in. Enums are written by name.
+type jsonFace struct {
+	BoundingPoly, FdBoundingPoly jsonPoly
+	Landmarks                    []struct {
+		Type     string
+		Position struct {
+			X, Y, Z float32
+		}
+	}
+	RollAngle, PanAngle, TiltAngle                                       float32
+	DetectionConfidence, LandmarkingConfidence                           float32
+	JoyLikelihood, SorrowLikelihood, AngerLikelihood, SurpriseLikelihood string
+	UnderExposedLikelihood, BlurredLikelihood, HeadwearLikelihood        string
+}
+
+func (f jsonFace) annotation() *pb.FaceAnnotation {
+	likelihood := func(name string) pb.Likelihood {
+		return pb.Likelihood(pb.Likelihood_value[name])
+	}
+	face := &pb.FaceAnnotation{
+		BoundingPoly:           f.BoundingPoly.poly(),
+		FdBoundingPoly:         f.FdBoundingPoly.poly(),
+		RollAngle:              f.RollAngle,
+		PanAngle:               f.PanAngle,
+		TiltAngle:              f.TiltAngle,
+		DetectionConfidence:    f.DetectionConfidence,
+		LandmarkingConfidence:  f.LandmarkingConfidence,
+		JoyLikelihood:          likelihood(f.JoyLikelihood),
+		SorrowLikelihood:       likelihood(f.SorrowLikelihood),
+		AngerLikelihood:        likelihood(f.AngerLikelihood),
+		SurpriseLikelihood:     likelihood(f.SurpriseLikelihood),
+		UnderExposedLikelihood: likelihood(f.UnderExposedLikelihood),
+		BlurredLikelihood:      likelihood(f.BlurredLikelihood),
+		HeadwearLikelihood:     likelihood(f.HeadwearLikelihood),
+	}
+	for _, lm := range f.Landmarks {
+		face.Landmarks = append(face.Landmarks, &pb.FaceAnnotation_Landmark{
+			Type:     pb.FaceAnnotation_Landmark_Type(pb.FaceAnnotation_Landmark_Type_value[lm.Type]),
+			Position: &pb.Position{X: lm.Position.X, Y: lm.Position.Y, Z: lm.Position.Z},
+		})
+	}
+	return face
+}
+
+// parseFileResults reads one of the result files of an asynchronous file
+// annotation and adds the faces it holds to pages, indexed from zero.
+func parseFileResults(data []byte, pages [][]*pb.FaceAnnotation) error {
+	var results struct {
+		Responses []struct {
+			FaceAnnotations []jsonFace
+			Error           *struct {
+				Message string
+			}
+			Context struct {
+				PageNumber int
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &results); err != nil {
+		return err
+	}
+	for _, r := range results.Responses {
+		page := r.Context.PageNumber
+		if r.Error != nil {
+			return fmt.Errorf("page %d: %s", page, r.Error.Message)
+		}
+		if page < 1 || page > len(pages) {
+			return fmt.Errorf("result for page %d of %d", page, len(pages))
+		}
+		for _, f := range r.FaceAnnotations {
+			pages[page-1] = append(pages[page-1], f.annotation())
+		}
+	}
+	return nil
+}
+
+// detectDocument runs face detection on every page of a TIFF file at once
+// with Vision's asynchronous file annotation, which reads the file from
+// Cloud Storage and writes its results there. The file and the results
+// are staged under stage and removed afterwards. It returns the faces of
+// every page, moved upright like the pages of decodeTIFFPages.
+func detectDocument(ctx context.Context, client *vision.ImageAnnotatorClient, gcs *gcsClient, stage gcsLocation, data []byte) ([][]*pb.FaceAnnotation, error) {
+	name := stage.prefix + "chrisify-" + inputHash(data)[:16]
+	if err := gcs.upload(ctx, stage.bucket, name+".tif", "image/tiff", data); err != nil {
+		return nil, err
+	}
+	defer gcs.remove(ctx, stage.bucket, name+".tif")
+
+	results := name + "/"
+	op, err := client.AsyncBatchAnnotateFiles(ctx, &pb.AsyncBatchAnnotateFilesRequest{
+		Requests: []*pb.AsyncAnnotateFileRequest{{
+			InputConfig: &pb.InputConfig{
+				GcsSource: &pb.GcsSource{Uri: stage.uri(name + ".tif")},
+				MimeType:  "image/tiff",
+			},
+			Features: []*pb.Feature{{Type: pb.Feature_FACE_DETECTION, MaxResults: 100}},
+			OutputConfig: &pb.OutputConfig{
+				GcsDestination: &pb.GcsDestination{Uri: stage.uri(results)},
+				BatchSize:      20,
+			},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := op.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	offsets := tiffPages(data)
+	pages := make([][]*pb.FaceAnnotation, len(offsets))
+	files, err := gcs.list(ctx, stage.bucket, results)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		result, err := gcs.download(ctx, stage.bucket, file)
+		if err == nil {
+			err = parseFileResults(result, pages)
+		}
+		gcs.remove(ctx, stage.bucket, file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Vision sees the stored pixels of every page.
+	for i, offset := range offsets {
+		page := tiffPage(data, offset)
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(page))
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %s", i+1, err)
+		}
+		orientation(fileOrientation(page)).faces(pages[i], cfg.Width, cfg.Height)
+	}
+	return pages, nil
+}
+
+// isDir reports whether path names a directory, either an existing one or
+// one spelled with a trailing separator.
+func isDir(path string) bool {
+	if path == "" {
+		return false
+	}
+	if os.IsPathSeparator(path[len(path)-1]) {
+		return true
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// writePages writes every page to dir as page-001.png, page-002.png and so
+// on, in the format selected by opts.
+func writePages(dir string, pages []image.Image, opts encodeOptions) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	ext := map[string]string{"jpeg": "jpg", "tiff": "tif"}[opts.format]
+	if ext == "" {
+		ext = opts.format
+	}
+	for i, page := range pages {
+		name := filepath.Join(dir, fmt.Sprintf("page-%03d.%s", i+1, ext))
+		if err := writeOutput(name, page, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+func TestEncodeTIFFPages(t *testing.T) {
+	colors := []color.NRGBA{
+		{255, 0, 0, 255},
+		{0, 255, 0, 255},
+		{0, 0, 255, 255},
+		{40, 80, 120, 255},
+	}
+	var pages []image.Image
+	for i, c := range colors {
+		// Every page has its own size, so the strip offsets and counts differ.
+		img := image.NewNRGBA(image.Rect(0, 0, 3+i*5, 2+i*7))
+		draw.Draw(img, img.Bounds(), image.NewUniform(c), image.ZP, draw.Src)
+		img.Set(0, 0, color.NRGBA{255, 255, 255, 255})
+		pages = append(pages, img)
+	}
+
+	for n := 1; n <= len(pages); n++ {
+		data, err := encodeTIFFPages(pages[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(tiffPages(data)); got != n {
+			t.Fatalf("%d pages: file has %d pages", n, got)
+		}
+		got, _, err := decodeTIFFPages(data)
+		if err != nil {
+			t.Fatalf("%d pages: %s", n, err)
+		}
+		for i, img := range got {
+			want := pages[i]
+			if img.Bounds().Size() != want.Bounds().Size() {
+				t.Errorf("%d pages: page %d is %v, want %v", n, i+1, img.Bounds().Size(), want.Bounds().Size())
+				continue
+			}
+			for _, p := range []image.Point{{0, 0}, {1, 1}, want.Bounds().Max.Sub(image.Pt(1, 1))} {
+				g := color.NRGBAModel.Convert(img.At(img.Bounds().Min.X+p.X, img.Bounds().Min.Y+p.Y))
+				if w := want.At(p.X, p.Y); g != w {
+					t.Errorf("%d pages: page %d at %v = %v, want %v", n, i+1, p, g, w)
+				}
+			}
+		}
+	}
+}
+
+func TestParseFileResults(t *testing.T) {
+	data := []byte(`{
+		"inputConfig": {"gcsSource": {"uri": "gs://b/doc.tif"}, "mimeType": "image/tiff"},
+		"responses": [
+			{"context": {"uri": "gs://b/doc.tif", "pageNumber": 2}, "faceAnnotations": [{
+				"boundingPoly": {"vertices": [{"x": 10, "y": 20}, {"x": 50, "y": 20}, {"x": 50, "y": 70}, {"y": 70}]},
+				"fdBoundingPoly": {"vertices": [{"x": 12, "y": 30}]},
+				"landmarks": [{"type": "LEFT_EYE", "position": {"x": 20.5, "y": 40, "z": -1}}],
+				"rollAngle": 3.5,
+				"detectionConfidence": 0.9,
+				"underExposedLikelihood": "VERY_LIKELY",
+				"joyLikelihood": "UNLIKELY"
+			}]},
+			{"context": {"uri": "gs://b/doc.tif", "pageNumber": 1}}
+		]
+	}`)
+	pages := make([][]*pb.FaceAnnotation, 3)
+	if err := parseFileResults(data, pages); err != nil {
+		t.Fatal(err)
+	}
+	if len(pages[0]) != 0 || len(pages[1]) != 1 || len(pages[2]) != 0 {
+		t.Fatalf("faces per page = %d, %d, %d, want 0, 1, 0", len(pages[0]), len(pages[1]), len(pages[2]))
+	}
+	f := pages[1][0]
+	if r := polyRect(f.BoundingPoly); r != image.Rect(0, 20, 50, 70) {
+		t.Errorf("bounding poly = %v", r)
+	}
+	if len(f.Landmarks) != 1 || f.Landmarks[0].Type != pb.FaceAnnotation_Landmark_LEFT_EYE || f.Landmarks[0].Position.X != 20.5 {
+		t.Errorf("landmarks = %v", f.Landmarks)
+	}
+	if f.RollAngle != 3.5 || f.DetectionConfidence != 0.9 {
+		t.Errorf("angles and confidence = %v, %v", f.RollAngle, f.DetectionConfidence)
+	}
+	if f.UnderExposedLikelihood != pb.Likelihood_VERY_LIKELY || f.JoyLikelihood != pb.Likelihood_UNLIKELY || f.BlurredLikelihood != pb.Likelihood_UNKNOWN {
+		t.Errorf("likelihoods = %v, %v, %v", f.UnderExposedLikelihood, f.JoyLikelihood, f.BlurredLikelihood)
+	}
+
+	for _, bad := range []string{
+		`{"responses": [{"context": {"pageNumber": 4}}]}`,
+		`{"responses": [{"context": {"pageNumber": 1}, "error": {"code": 3, "message": "bad image"}}]}`,
+		`not json`,
+	} {
+		if err := parseFileResults([]byte(bad), pages); err == nil {
+			t.Errorf("parseFileResults(%s) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// jpegSegment is a marker segment from the header of a JPEG file.
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+// jpegSegments returns the marker segments of a JPEG file up to the start
+// of the scan data. It returns nil if data is not a JPEG.
+func jpegSegments(data []byte) []jpegSegment {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	var segs []jpegSegment
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			break
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			// Fill byte.
+			i++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			break
+		}
+		segs = append(segs, jpegSegment{marker: marker, data: data[i+4 : i+2+n]})
+		i += 2 + n
+	}
+	return segs
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// jpegEXIF returns the TIFF structured EXIF block of a JPEG file, or nil.
+func jpegEXIF(data []byte) []byte {
+	for _, seg := range jpegSegments(data) {
+		if seg.marker == 0xe1 && bytes.HasPrefix(seg.data, exifHeader) {
+			return seg.data[len(exifHeader):]
+		}
+	}
+	return nil
+}
+
+// isWebP reports whether data is a WebP file.
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP"))
+}
+
+// webpChunk returns the payload of the first chunk of a WebP file with the
+// given FourCC, or nil.
+func webpChunk(data []byte, fourCC string) []byte {
+	if !isWebP(data) {
+		return nil
+	}
+	i := 12
+	for i+8 <= len(data) {
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if n < 0 || i+8+n > len(data) {
+			break
+		}
+		if string(data[i:i+4]) == fourCC {
+			return data[i+8 : i+8+n]
+		}
+		// Chunks are padded to an even size.
+		i += 8 + n + n&1
+	}
+	return nil
+}
+
+// webpEXIF returns the TIFF structured EXIF block of a WebP file, or nil.
+// Some writers keep the JPEG style "Exif" header in front of it.
+func webpEXIF(data []byte) []byte {
+	exif := webpChunk(data, "EXIF")
+	return bytes.TrimPrefix(exif, exifHeader)
+}
+
+// isTIFF reports whether data starts with a TIFF header.
+func isTIFF(data []byte) bool {
+	return len(data) >= 8 &&
+		(bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")))
+}
+
+// tiffByteOrder returns the byte order declared by a TIFF header.
+func tiffByteOrder(data []byte) binary.ByteOrder {
+	if data[0] == 'M' {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// tiffEntry is an entry of a TIFF image file directory.
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte // The raw 4 bytes of the value or offset field.
+	pos      int    // The offset of the entry itself.
+}
+
+var tiffTypeSize = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// size returns the byte size of the entry's value.
+func (e tiffEntry) size() int {
+	return tiffTypeSize[e.typ] * int(e.count)
+}
+
+// tiffIFD reads the directory at offset in a TIFF structure and returns
+// its entries and the offset of the next directory.
+func tiffIFD(data []byte, offset uint32) ([]tiffEntry, uint32) {
+	if !isTIFF(data) || int64(offset)+2 > int64(len(data)) {
+		return nil, 0
+	}
+	order := tiffByteOrder(data)
+	n := int(order.Uint16(data[offset:]))
+	p := int(offset) + 2
+	if p+n*12+4 > len(data) {
+		return nil, 0
+	}
+	entries := make([]tiffEntry, n)
+	for i := range entries {
+		e := data[p+i*12:]
+		entries[i] = tiffEntry{
+			tag:   order.Uint16(e),
+			typ:   order.Uint16(e[2:]),
+			count: order.Uint32(e[4:]),
+			value: e[8:12],
+			pos:   p + i*12,
+		}
+	}
+	return entries, order.Uint32(data[p+n*12:])
+}
+
+// tiffFirstIFD returns the offset of the first directory of a TIFF structure.
+func tiffFirstIFD(data []byte) uint32 {
+	if !isTIFF(data) {
+		return 0
+	}
+	return tiffByteOrder(data).Uint32(data[4:])
+}
+
+const tagOrientation = 0x0112
+
+// exifOrientation returns the orientation tag of the first directory of a
+// TIFF structure, or 1 if there is none.
+func exifOrientation(data []byte) int {
+	entries, _ := tiffIFD(data, tiffFirstIFD(data))
+	for _, e := range entries {
+		if e.tag == tagOrientation && e.typ == 3 {
+			if o := int(tiffByteOrder(data).Uint16(e.value)); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// fileOrientation returns the EXIF orientation of an encoded JPEG, TIFF or
+// WebP image, or 1 when it has none.
+func fileOrientation(data []byte) int {
+	if isTIFF(data) {
+		return exifOrientation(data)
+	}
+	if exif := webpEXIF(data); exif != nil {
+		return exifOrientation(exif)
+	}
+	if exif := jpegEXIF(data); exif != nil {
+		return exifOrientation(exif)
+	}
+	return 1
+}
+
+const (
+	tagEXIFIFD      = 0x8769
+	tagGPSIFD       = 0x8825
+	tagInteropIFD   = 0xa005
+	tagThumbnail    = 0x0201
+	tagThumbnailLen = 0x0202
+)
+
+// photoTags are the tags of a TIFF file's first directory that describe
+// the photo rather than how its pixels are stored.
+var photoTags = map[uint16]bool{
+	0x010e:         true, // ImageDescription
+	0x010f:         true, // Make
+	0x0110:         true, // Model
+	tagOrientation: true,
+	0x0131:         true, // Software
+	0x0132:         true, // DateTime
+	0x013b:         true, // Artist
+	0x8298:         true, // Copyright
+}
+
+// entryData returns the value of e, read from the TIFF structure data.
+func entryData(data []byte, e tiffEntry) []byte {
+	n := e.size()
+	if n <= 4 {
+		return e.value[:n]
+	}
+	off := int64(tiffByteOrder(data).Uint32(e.value))
+	if off+int64(n) > int64(len(data)) {
+		return nil
+	}
+	return data[off : off+int64(n)]
+}
+
+// appendIFD appends a directory of entries, followed by the values that do
+// not fit in it, to the TIFF structure buf. It returns the extended buffer
+// and the position of every entry's value field.
+func appendIFD(buf []byte, order binary.ByteOrder, entries []tiffEntry, values [][]byte) ([]byte, map[uint16]int) {
+	idx := make([]int, len(entries))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool { return entries[idx[i]].tag < entries[idx[j]].tag })
+
+	start := len(buf)
+	buf = append(buf, make([]byte, 2+12*len(entries)+4)...)
+	order.PutUint16(buf[start:], uint16(len(entries)))
+	pos := map[uint16]int{}
+	for i, k := range idx {
+		e, v := entries[k], values[k]
+		p := start + 2 + 12*i
+		order.PutUint16(buf[p:], e.tag)
+		order.PutUint16(buf[p+2:], e.typ)
+		order.PutUint32(buf[p+4:], e.count)
+		if len(v) <= 4 {
+			copy(buf[p+8:], v)
+		} else {
+			order.PutUint32(buf[p+8:], uint32(len(buf)))
+			buf = append(buf, v...)
+			// Values start on a word boundary.
+			if len(buf)%2 == 1 {
+				buf = append(buf, 0)
+			}
+		}
+		pos[e.tag] = p + 8
+	}
+	return buf, pos
+}
+
+// tiffDir is a directory to be written with appendIFD.
+type tiffDir struct {
+	entries []tiffEntry
+	values  [][]byte
+}
+
+// photoDirs collects the descriptive tags of a TIFF structure: those of
+// photoTags in its first directory and its EXIF and GPS directories, keyed
+// by the tag pointing to them. The first directory includes the pointers,
+// to be filled in by appendPhotoDirs.
+func photoDirs(data []byte) (tiffDir, map[uint16]tiffDir) {
+	entries, _ := tiffIFD(data, tiffFirstIFD(data))
+	order := tiffByteOrder(data)
+	collect := func(entries []tiffEntry, keep func(tiffEntry) bool) tiffDir {
+		var d tiffDir
+		for _, e := range entries {
+			if v := entryData(data, e); keep(e) && v != nil && tiffTypeSize[e.typ] > 0 {
+				d.entries = append(d.entries, e)
+				d.values = append(d.values, v)
+			}
+		}
+		return d
+	}
+
+	ifd0 := collect(entries, func(e tiffEntry) bool { return photoTags[e.tag] })
+	subs := map[uint16]tiffDir{}
+	for _, e := range entries {
+		if (e.tag != tagEXIFIFD && e.tag != tagGPSIFD) || e.count != 1 {
+			continue
+		}
+		sub, _ := tiffIFD(data, order.Uint32(e.value))
+		// Pointers to further directories inside would dangle.
+		d := collect(sub, func(e tiffEntry) bool { return e.tag != tagInteropIFD })
+		if len(d.entries) > 0 {
+			subs[e.tag] = d
+			ifd0.entries = append(ifd0.entries, tiffEntry{tag: e.tag, typ: 4, count: 1})
+			ifd0.values = append(ifd0.values, make([]byte, 4))
+		}
+	}
+	return ifd0, subs
+}
+
+// appendPhotoDirs appends ifd0 and the directories it points to, see
+// photoDirs. It returns the extended buffer and the position of ifd0.
+func appendPhotoDirs(buf []byte, order binary.ByteOrder, ifd0 tiffDir, subs map[uint16]tiffDir) ([]byte, int) {
+	start := len(buf)
+	buf, pos := appendIFD(buf, order, ifd0.entries, ifd0.values)
+	for _, tag := range []uint16{tagEXIFIFD, tagGPSIFD} {
+		if sub, ok := subs[tag]; ok {
+			order.PutUint32(buf[pos[tag]:], uint32(len(buf)))
+			buf, _ = appendIFD(buf, order, sub.entries, sub.values)
+		}
+	}
+	return buf, start
+}
+
+// reorderDir converts the values of d from one byte order to the other.
+func reorderDir(d tiffDir, from, to binary.ByteOrder) tiffDir {
+	if from == to {
+		return d
+	}
+	out := tiffDir{entries: d.entries}
+	for i, e := range d.entries {
+		word := tiffTypeSize[e.typ]
+		if e.typ == 5 || e.typ == 10 {
+			// Rationals are two longs.
+			word = 4
+		}
+		v := append([]byte(nil), d.values[i]...)
+		for j := 0; word > 1 && j+word <= len(v); j += word {
+			for a, b := j, j+word-1; a < b; a, b = a+1, b-1 {
+				v[a], v[b] = v[b], v[a]
+			}
+		}
+		out.values = append(out.values, v)
+	}
+	return out
+}
+
+// tiffEXIF builds an EXIF block out of the descriptive tags of a TIFF
+// file, see photoDirs. It returns nil if there are none.
+func tiffEXIF(data []byte) []byte {
+	ifd0, subs := photoDirs(data)
+	if len(ifd0.entries) == 0 {
+		return nil
+	}
+	order := tiffByteOrder(data)
+	buf := append([]byte(nil), data[:4]...)
+	buf = append(buf, 0, 0, 0, 0)
+	order.PutUint32(buf[4:], 8)
+	buf, _ = appendPhotoDirs(buf, order, ifd0, subs)
+	return buf
+}
+
+// zeroIFD clears the directory at offset and the values it points to.
+func zeroIFD(data []byte, offset uint32) {
+	entries, _ := tiffIFD(data, offset)
+	if entries == nil {
+		return
+	}
+	order := tiffByteOrder(data)
+	wipe := func(off, n int) {
+		if off >= 0 && n >= 0 && off+n <= len(data) {
+			for i := off; i < off+n; i++ {
+				data[i] = 0
+			}
+		}
+	}
+	var thumb, thumbLen int
+	for _, e := range entries {
+		switch e.tag {
+		case tagThumbnail:
+			thumb = int(order.Uint32(e.value))
+		case tagThumbnailLen:
+			thumbLen = int(order.Uint32(e.value))
+		}
+		if e.size() > 4 {
+			wipe(int(order.Uint32(e.value)), e.size())
+		}
+	}
+	wipe(thumb, thumbLen)
+	wipe(int(offset), 2+len(entries)*12+4)
+}
+
+// cleanEXIF returns a copy of an EXIF block fit for the output image: the
+// orientation is reset since the pixels are already upright and the
+// thumbnail, which still shows the original faces, is dropped. With
+// stripGPS the GPS directory is removed as well.
+func cleanEXIF(exif []byte, stripGPS bool) []byte {
+	if !isTIFF(exif) {
+		return nil
+	}
+	data := append([]byte(nil), exif...)
+	order := tiffByteOrder(data)
+	ifd0 := tiffFirstIFD(data)
+	entries, next := tiffIFD(data, ifd0)
+	if entries == nil {
+		return nil
+	}
+	nextPos := int(ifd0) + 2 + len(entries)*12
+
+	if next != 0 {
+		zeroIFD(data, next)
+		order.PutUint32(data[nextPos:], 0)
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		switch {
+		case e.tag == tagOrientation && e.typ == 3:
+			order.PutUint16(e.value, 1)
+		case e.tag == tagGPSIFD && stripGPS:
+			zeroIFD(data, order.Uint32(e.value))
+			// Move the following entries and the next directory offset up
+			// over the removed entry.
+			copy(data[e.pos:], data[e.pos+12:nextPos+4])
+			nextPos -= 12
+			for j := nextPos + 4; j < nextPos+16; j++ {
+				data[j] = 0
+			}
+			order.PutUint16(data[ifd0:], order.Uint16(data[ifd0:])-1)
+		}
+	}
+	return data
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+var (
+	testMake      = []byte("Testcam\x00")
+	testLatitude  = []byte{0, 0, 0, 52, 0, 0, 0, 1, 0, 0, 0, 31, 0, 0, 0, 1, 0, 0, 0, 7, 0, 0, 0, 1}
+	testThumbnail = []byte("\xff\xd8THUMBNAIL\xff\xd9")
+)
+
+func short(order binary.ByteOrder, v uint16) []byte {
+	b := make([]byte, 4)
+	order.PutUint16(b, v)
+	return b
+}
+
+func long(order binary.ByteOrder, v uint32) []byte {
+	b := make([]byte, 4)
+	order.PutUint32(b, v)
+	return b
+}
+
+// tiffHeader starts a TIFF structure whose first directory follows at 8.
+func tiffHeader(order binary.ByteOrder) []byte {
+	buf := []byte("II*\x00\x08\x00\x00\x00")
+	if order == binary.BigEndian {
+		buf = []byte("MM\x00*\x00\x00\x00\x08")
+	}
+	return buf
+}
+
+// exifFixture builds an EXIF block with a make, the given orientation, a
+// GPS directory and a thumbnail in a second directory.
+func exifFixture(order binary.ByteOrder, orient uint16) []byte {
+	buf := tiffHeader(order)
+	buf, pos := appendIFD(buf, order, []tiffEntry{
+		{tag: 0x010f, typ: 2, count: uint32(len(testMake))},
+		{tag: tagOrientation, typ: 3, count: 1},
+		{tag: tagGPSIFD, typ: 4, count: 1},
+	}, [][]byte{testMake, short(order, orient), make([]byte, 4)})
+	next := 8 + 2 + 3*12
+
+	order.PutUint32(buf[pos[tagGPSIFD]:], uint32(len(buf)))
+	buf, _ = appendIFD(buf, order, []tiffEntry{
+		{tag: 1, typ: 2, count: 2},
+		{tag: 2, typ: 5, count: 3},
+	}, [][]byte{[]byte("N\x00"), testLatitude})
+
+	order.PutUint32(buf[next:], uint32(len(buf)))
+	buf, pos = appendIFD(buf, order, []tiffEntry{
+		{tag: tagThumbnail, typ: 4, count: 1},
+		{tag: tagThumbnailLen, typ: 4, count: 1},
+	}, [][]byte{make([]byte, 4), long(order, uint32(len(testThumbnail)))})
+	order.PutUint32(buf[pos[tagThumbnail]:], uint32(len(buf)))
+	return append(buf, testThumbnail...)
+}
+
+func hasTag(exif []byte, tag uint16) bool {
+	entries, _ := tiffIFD(exif, tiffFirstIFD(exif))
+	for _, e := range entries {
+		if e.tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCleanEXIF(t *testing.T) {
+	tests := []struct {
+		name     string
+		order    binary.ByteOrder
+		orient   uint16
+		stripGPS bool
+	}{
+		{"little endian", binary.LittleEndian, 6, false},
+		{"big endian", binary.BigEndian, 8, false},
+		{"strip gps little endian", binary.LittleEndian, 3, true},
+		{"strip gps big endian", binary.BigEndian, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := exifFixture(tt.order, tt.orient)
+			if got := exifOrientation(in); got != int(tt.orient) {
+				t.Fatalf("fixture orientation = %d, want %d", got, tt.orient)
+			}
+			out := cleanEXIF(in, tt.stripGPS)
+
+			if got := exifOrientation(out); got != 1 {
+				t.Errorf("orientation = %d, want 1", got)
+			}
+			if !bytes.Contains(out, testMake) {
+				t.Error("make was lost")
+			}
+
+			if _, next := tiffIFD(out, tiffFirstIFD(out)); next != 0 {
+				t.Errorf("next directory = %d, want 0", next)
+			}
+			if bytes.Contains(out, testThumbnail[2:11]) {
+				t.Error("thumbnail was not wiped")
+			}
+
+			if got := hasTag(out, tagGPSIFD); got == tt.stripGPS {
+				t.Errorf("GPS directory present = %t, want %t", got, !tt.stripGPS)
+			}
+			if got := bytes.Contains(out, testLatitude); got == tt.stripGPS {
+				t.Errorf("GPS latitude present = %t, want %t", got, !tt.stripGPS)
+			}
+
+			if !bytes.Equal(in, exifFixture(tt.order, tt.orient)) {
+				t.Error("input was modified")
+			}
+		})
+	}
+}
+
+func TestCleanEXIFInvalid(t *testing.T) {
+	for _, in := range [][]byte{nil, []byte("Exif\x00\x00"), []byte("II*\x00\xff\xff\x00\x00")} {
+		if out := cleanEXIF(in, true); out != nil {
+			t.Errorf("cleanEXIF(%q) = %q, want nil", in, out)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+)
+
+// gcsLocation is a Cloud Storage bucket and a prefix for object names.
+type gcsLocation struct {
+	bucket, prefix string
+}
+
+// parseGCSLocation splits a gs://bucket/prefix URI.
+func parseGCSLocation(uri string) (gcsLocation, error) {
+	if !strings.HasPrefix(uri, "gs://") {
+		return gcsLocation{}, fmt.Errorf("not a gs:// URI: %s", uri)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, "gs://"), "/", 2)
+	if parts[0] == "" {
+		return gcsLocation{}, fmt.Errorf("no bucket in %s", uri)
+	}
+	l := gcsLocation{bucket: parts[0]}
+	if len(parts) == 2 && parts[1] != "" {
+		l.prefix = strings.TrimSuffix(parts[1], "/") + "/"
+	}
+	return l, nil
+}
+
+// uri returns the gs:// URI of the object name.
+func (l gcsLocation) uri(name string) string {
+	return "gs://" + l.bucket + "/" + name
+}
+
+// gcsClient is a minimal client of the Cloud Storage JSON API, enough to
+// stage documents for Vision and collect its results.
+type gcsClient struct {
+	http     *http.Client
+	endpoint string
+}
+
+// newGCSClient returns a client using the application default credentials,
+// the same ones the Vision client uses.
+func newGCSClient(ctx context.Context) (*gcsClient, error) {
+	c, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/devstorage.read_write")
+	if err != nil {
+		return nil, err
+	}
+	return &gcsClient{http: c, endpoint: "https://storage.googleapis.com"}, nil
+}
+
+// do sends a request and returns the response body, failing on any status
+// but 2xx.
+func (c *gcsClient) do(ctx context.Context, method, path string, body io.Reader, contentType string) ([]byte, error) {
+	req, err := http.NewRequest(method, c.endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return data, nil
+}
+
+func objectPath(bucket, name string) string {
+	return "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(name)
+}
+
+// upload stores data as the object name.
+func (c *gcsClient) upload(ctx context.Context, bucket, name, contentType string, data []byte) error {
+	path := "/upload/storage/v1/b/" + url.PathEscape(bucket) + "/o?uploadType=media&name=" + url.QueryEscape(name)
+	_, err := c.do(ctx, "POST", path, bytes.NewReader(data), contentType)
+	return err
+}
+
+// download returns the contents of the object name.
+func (c *gcsClient) download(ctx context.Context, bucket, name string) ([]byte, error) {
+	return c.do(ctx, "GET", objectPath(bucket, name)+"?alt=media", nil, "")
+}
+
+// remove deletes the object name.
+func (c *gcsClient) remove(ctx context.Context, bucket, name string) error {
+	_, err := c.do(ctx, "DELETE", objectPath(bucket, name), nil, "")
+	return err
+}
+
+// list returns the names of the objects starting with prefix.
+func (c *gcsClient) list(ctx context.Context, bucket, prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		q := url.Values{"prefix": {prefix}}
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+		data, err := c.do(ctx, "GET", "/storage/v1/b/"+url.PathEscape(bucket)+"/o?"+q.Encode(), nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items []struct {
+				Name string
+			}
+			NextPageToken string
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			names = append(names, item.Name)
+		}
+		if page.NextPageToken == "" {
+			return names, nil
+		}
+		token = page.NextPageToken
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseGCSLocation(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want gcsLocation
+	}{
+		{"gs://bucket", gcsLocation{"bucket", ""}},
+		{"gs://bucket/", gcsLocation{"bucket", ""}},
+		{"gs://bucket/scans", gcsLocation{"bucket", "scans/"}},
+		{"gs://bucket/scans/2019/", gcsLocation{"bucket", "scans/2019/"}},
+	}
+	for _, tt := range tests {
+		got, err := parseGCSLocation(tt.uri)
+		if err != nil || got != tt.want {
+			t.Errorf("parseGCSLocation(%q) = %v, %v, want %v", tt.uri, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "bucket/scans", "gs://", "s3://bucket"} {
+		if _, err := parseGCSLocation(bad); err == nil {
+			t.Errorf("parseGCSLocation(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestGCSClient(t *testing.T) {
+	objects := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const objectsPath = "/storage/v1/b/bucket/o"
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/upload"+objectsPath:
+			body, _ := ioutil.ReadAll(r.Body)
+			objects[r.URL.Query().Get("name")] = string(body)
+		case r.Method == "GET" && r.URL.Path == objectsPath:
+			// One object per page to exercise the page tokens.
+			var names []string
+			for name := range objects {
+				if strings.HasPrefix(name, r.URL.Query().Get("prefix")) && name > r.URL.Query().Get("pageToken") {
+					names = append(names, name)
+				}
+			}
+			if len(names) == 0 {
+				w.Write([]byte(`{}`))
+				return
+			}
+			first := names[0]
+			for _, name := range names {
+				if name < first {
+					first = name
+				}
+			}
+			w.Write([]byte(`{"items": [{"name": "` + first + `"}], "nextPageToken": "` + first + `"}`))
+		case strings.HasPrefix(r.URL.Path, objectsPath+"/"):
+			name := strings.TrimPrefix(r.URL.Path, objectsPath+"/")
+			body, ok := objects[name]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			if r.Method == "DELETE" {
+				delete(objects, name)
+				return
+			}
+			w.Write([]byte(body))
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	c := &gcsClient{http: server.Client(), endpoint: server.URL}
+	for _, name := range []string{"out/a.json", "out/b.json", "doc.tif"} {
+		if err := c.upload(ctx, "bucket", name, "application/json", []byte("data of "+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := c.list(ctx, "bucket", "out/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"out/a.json", "out/b.json"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("list = %q, want %q", names, want)
+	}
+	data, err := c.download(ctx, "bucket", "out/b.json")
+	if err != nil || string(data) != "data of out/b.json" {
+		t.Errorf("download = %q, %v", data, err)
+	}
+	if err := c.remove(ctx, "bucket", "out/b.json"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.download(ctx, "bucket", "out/b.json"); err == nil {
+		t.Error("removed object can still be downloaded")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"sort"
+
+	"cloud.google.com/go/vision/apiv1"
+	"golang.org/x/net/context"
+)
+
+// isGIF reports whether data is a GIF file.
+func isGIF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF8"))
+}
+
+// gifFrames renders every frame of g onto a full size canvas, applying the
+// disposal method of the previous frames, so that each returned image is
+// exactly what a viewer shows at that point of the animation.
+func gifFrames(g *gif.GIF) []*image.NRGBA {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() && len(g.Image) > 0 {
+		bounds = g.Image[0].Bounds()
+	}
+	canvas := image.NewNRGBA(bounds)
+	frames := make([]*image.NRGBA, 0, len(g.Image))
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneNRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		frames = append(frames, cloneNRGBA(canvas))
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+func cloneNRGBA(img *image.NRGBA) *image.NRGBA {
+	c := image.NewNRGBA(img.Rect)
+	copy(c.Pix, img.Pix)
+	return c
+}
+
+// colorBox is a box of colors in RGB space used by the median cut.
+type colorBox []color.NRGBA
+
+// spread returns the channel with the widest range in the box and that range.
+func (b colorBox) spread() (int, int) {
+	lo := [3]uint8{255, 255, 255}
+	var hi [3]uint8
+	for _, c := range b {
+		for i, v := range [3]uint8{c.R, c.G, c.B} {
+			if v < lo[i] {
+				lo[i] = v
+			}
+			if v > hi[i] {
+				hi[i] = v
+			}
+		}
+	}
+	channel, width := 0, -1
+	for i := range lo {
+		if w := int(hi[i]) - int(lo[i]); w > width {
+			channel, width = i, w
+		}
+	}
+	return channel, width
+}
+
+// mean returns the average color of the box.
+func (b colorBox) mean() color.NRGBA {
+	var r, g, bl int
+	for _, c := range b {
+		r += int(c.R)
+		g += int(c.G)
+		bl += int(c.B)
+	}
+	n := len(b)
+	return color.NRGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 0xff}
+}
+
+// medianCut builds a palette of at most n colors for the opaque pixels of
+// all the given images, so every frame of an animation can share it.
+func medianCut(imgs []image.Image, n int) color.Palette {
+	var pixels colorBox
+	total := 0
+	for _, img := range imgs {
+		b := img.Bounds()
+		total += b.Dx() * b.Dy()
+	}
+	// Sample at most about a million pixels.
+	step := total/(1<<20) + 1
+	k := 0
+	for _, img := range imgs {
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				k++
+				if k%step != 0 {
+					continue
+				}
+				c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				if c.A >= 0x80 {
+					pixels = append(pixels, c)
+				}
+			}
+		}
+	}
+	if len(pixels) == 0 {
+		return color.Palette{color.Black}
+	}
+
+	boxes := []colorBox{pixels}
+	for len(boxes) < n {
+		// Split the box with the most pixels times color range.
+		best, bestScore := -1, 0
+		for i, b := range boxes {
+			if _, w := b.spread(); w > 0 && w*len(b) > bestScore {
+				best, bestScore = i, w*len(b)
+			}
+		}
+		if best < 0 {
+			break
+		}
+		b := boxes[best]
+		channel, _ := b.spread()
+		sort.Slice(b, func(i, j int) bool {
+			ci, cj := b[i], b[j]
+			return [3]uint8{ci.R, ci.G, ci.B}[channel] < [3]uint8{cj.R, cj.G, cj.B}[channel]
+		})
+		mid := len(b) / 2
+		boxes[best] = b[:mid]
+		boxes = append(boxes, b[mid:])
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for i, b := range boxes {
+		palette[i] = b.mean()
+	}
+	return palette
+}
+
+// encodeAnimation quantizes frames to a shared median cut palette and
+// builds the GIF to write, keeping delays and looping from src.
+func encodeAnimation(frames []image.Image, src *gif.GIF) *gif.GIF {
+	transparent := false
+	for _, f := range frames {
+		if !opaque(f) {
+			transparent = true
+			break
+		}
+	}
+	colors := 256
+	if transparent {
+		colors--
+	}
+	palette := medianCut(frames, colors)
+	disposal := byte(gif.DisposalNone)
+	if transparent {
+		// Every frame is a full canvas, clearing keeps transparent areas
+		// from showing the previous frame.
+		palette = append(palette, color.Transparent)
+		disposal = gif.DisposalBackground
+	}
+
+	out := &gif.GIF{
+		LoopCount: src.LoopCount,
+		Config: image.Config{
+			ColorModel: palette,
+			Width:      src.Config.Width,
+			Height:     src.Config.Height,
+		},
+	}
+	for i, f := range frames {
+		p := image.NewPaletted(f.Bounds(), palette)
+		draw.FloydSteinberg.Draw(p, p.Rect, f, f.Bounds().Min)
+		out.Image = append(out.Image, p)
+		delay := 10
+		if i < len(src.Delay) {
+			delay = src.Delay[i]
+		}
+		out.Delay = append(out.Delay, delay)
+		out.Disposal = append(out.Disposal, disposal)
+	}
+	return out
+}
+
+// opaque reports whether every pixel of img is fully opaque.
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// chrisifyGIF replaces the faces in every frame of an animated GIF.
+// Detection runs on every nth frame, the frames in between reuse the
+// tracked faces. Every tracked face keeps its library face throughout.
+func chrisifyGIF(ctx context.Context, client *vision.ImageAnnotatorClient, g *gif.GIF, library FaceList, opts renderOptions, every int, smoothing float64) (*gif.GIF, error) {
+	if every < 1 {
+		every = 1
+	}
+	tr := newTracker(library, smoothing)
+	var out []image.Image
+	for i, frame := range gifFrames(g) {
+		tr.tick()
+		if i%every == 0 {
+			faces, err := detectImage(ctx, client, frame)
+			if err != nil {
+				return nil, err
+			}
+			tr.update(suppressDuplicates(faces, opts.nms))
+		}
+		faces, assign := tr.faces()
+		if len(faces) == 0 {
+			// render would add the peeking face to frames between tracks.
+			out = append(out, frame)
+			continue
+		}
+		out = append(out, render(frame, faces, library, assign, opts))
+	}
+	return encodeAnimation(out, g), nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// toneCurve is an ICC tone reproduction curve mapping encoded values to
+// linear light, both in [0, 1].
+type toneCurve struct {
+	// table holds a sampled curve; if empty, params holds the parameters
+	// of an ICC parametric curve of type kind.
+	table  []float64
+	kind   int
+	params [7]float64
+}
+
+// decode maps an encoded value to linear light.
+func (t toneCurve) decode(v float64) float64 {
+	if len(t.table) > 0 {
+		if len(t.table) == 1 {
+			return v
+		}
+		f := v * float64(len(t.table)-1)
+		i := int(f)
+		if i >= len(t.table)-1 {
+			return t.table[len(t.table)-1]
+		}
+		frac := f - float64(i)
+		return t.table[i]*(1-frac) + t.table[i+1]*frac
+	}
+	g, a, b, c, d, e, f := t.params[0], t.params[1], t.params[2], t.params[3], t.params[4], t.params[5], t.params[6]
+	pow := func(x float64) float64 {
+		if x <= 0 {
+			return 0
+		}
+		return math.Pow(x, g)
+	}
+	switch t.kind {
+	case 1:
+		if v >= -b/a {
+			return pow(a*v + b)
+		}
+		return 0
+	case 2:
+		if v >= -b/a {
+			return pow(a*v+b) + c
+		}
+		return c
+	case 3:
+		if v >= d {
+			return pow(a*v + b)
+		}
+		return c * v
+	case 4:
+		if v >= d {
+			return pow(a*v+b) + e
+		}
+		return c*v + f
+	}
+	return pow(v)
+}
+
+// iccProfile is a matrix/TRC RGB ICC profile.
+type iccProfile struct {
+	// toXYZ maps linear RGB to the D50 XYZ connection space, row major.
+	toXYZ [9]float64
+	trc   [3]toneCurve
+
+	// decodeLUT and encodeLUT map 16-bit encoded values to linear light
+	// and back, per channel. They are built on first use.
+	decodeLUT [3][]float32
+	encodeLUT [3][]uint16
+}
+
+// srgbProfile returns the sRGB profile, the working space of chrisify.
+func srgbProfile() *iccProfile {
+	curve := toneCurve{kind: 3, params: [7]float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045}}
+	return &iccProfile{
+		toXYZ: [9]float64{
+			0.4360747, 0.3850649, 0.1430804,
+			0.2225045, 0.7168786, 0.0606169,
+			0.0139322, 0.0971045, 0.7141733,
+		},
+		trc: [3]toneCurve{curve, curve, curve},
+	}
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseICC parses the colorant and tone curve tags of an RGB ICC profile.
+func parseICC(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("not an ICC profile")
+	}
+	if string(data[16:20]) != "RGB " {
+		return nil, fmt.Errorf("unsupported ICC color space %q", data[16:20])
+	}
+	tags := map[string][]byte{}
+	n := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < n && 132+i*12+12 <= len(data); i++ {
+		t := data[132+i*12:]
+		off, size := binary.BigEndian.Uint32(t[4:]), binary.BigEndian.Uint32(t[8:])
+		if int64(off)+int64(size) <= int64(len(data)) {
+			tags[string(t[:4])] = data[off : off+size]
+		}
+	}
+
+	p := &iccProfile{}
+	for i, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		t := tags[name]
+		if len(t) < 20 || string(t[:4]) != "XYZ " {
+			return nil, fmt.Errorf("ICC profile has no %s tag, only matrix/TRC profiles are supported", name)
+		}
+		for row := 0; row < 3; row++ {
+			p.toXYZ[row*3+i] = s15Fixed16(t[8+row*4:])
+		}
+	}
+	for i, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseCurve(tags[name])
+		if err != nil {
+			return nil, fmt.Errorf("ICC %s: %v", name, err)
+		}
+		p.trc[i] = curve
+	}
+	return p, nil
+}
+
+func parseCurve(t []byte) (toneCurve, error) {
+	if len(t) < 12 {
+		return toneCurve{}, fmt.Errorf("missing tone curve")
+	}
+	switch string(t[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(t[8:]))
+		switch {
+		case n == 0:
+			return toneCurve{params: [7]float64{1}}, nil
+		case n == 1 && len(t) >= 14:
+			return toneCurve{params: [7]float64{float64(binary.BigEndian.Uint16(t[12:])) / 256}}, nil
+		case len(t) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(t[12+2*i:])) / 0xffff
+			}
+			return toneCurve{table: table}, nil
+		}
+	case "para":
+		kind := int(binary.BigEndian.Uint16(t[8:]))
+		count := []int{1, 3, 4, 5, 7}
+		if kind < len(count) && len(t) >= 12+4*count[kind] {
+			c := toneCurve{kind: kind}
+			for i := 0; i < count[kind]; i++ {
+				c.params[i] = s15Fixed16(t[12+4*i:])
+			}
+			return c, nil
+		}
+	}
+	return toneCurve{}, fmt.Errorf("unsupported tone curve")
+}
+
+// luts builds the lookup tables of p.
+func (p *iccProfile) luts() {
+	if p.decodeLUT[0] != nil {
+		return
+	}
+	for c := 0; c < 3; c++ {
+		dec := make([]float32, 1<<16)
+		for i := range dec {
+			dec[i] = float32(p.trc[c].decode(float64(i) / 0xffff))
+		}
+		// Tone curves are monotonic, so the inverse is found by walking
+		// the decode table alongside the linear values.
+		enc := make([]uint16, 1<<16)
+		j := 0
+		for i := range enc {
+			target := float32(i) / 0xffff
+			for j < len(dec)-1 && dec[j] < target {
+				j++
+			}
+			enc[i] = uint16(j)
+		}
+		p.decodeLUT[c], p.encodeLUT[c] = dec, enc
+	}
+}
+
+// invert3 returns the inverse of a row major 3×3 matrix.
+func invert3(m [9]float64) [9]float64 {
+	det := m[0]*(m[4]*m[8]-m[5]*m[7]) - m[1]*(m[3]*m[8]-m[5]*m[6]) + m[2]*(m[3]*m[7]-m[4]*m[6])
+	return [9]float64{
+		(m[4]*m[8] - m[5]*m[7]) / det, (m[2]*m[7] - m[1]*m[8]) / det, (m[1]*m[5] - m[2]*m[4]) / det,
+		(m[5]*m[6] - m[3]*m[8]) / det, (m[0]*m[8] - m[2]*m[6]) / det, (m[2]*m[3] - m[0]*m[5]) / det,
+		(m[3]*m[7] - m[4]*m[6]) / det, (m[1]*m[6] - m[0]*m[7]) / det, (m[0]*m[4] - m[1]*m[3]) / det,
+	}
+}
+
+func mul3(a, b [9]float64) [9]float64 {
+	var m [9]float64
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			m[r*3+c] = a[r*3]*b[c] + a[r*3+1]*b[3+c] + a[r*3+2]*b[6+c]
+		}
+	}
+	return m
+}
+
+// convertProfile converts img from one RGB profile to another. Deep
+// images stay deep.
+func convertProfile(img image.Image, from, to *iccProfile) image.Image {
+	from.luts()
+	to.luts()
+	m := mul3(invert3(to.toXYZ), from.toXYZ)
+
+	b := img.Bounds()
+	var dst draw.Image
+	if isDeep(img) {
+		dst = image.NewNRGBA64(b)
+	} else {
+		dst = image.NewNRGBA(b)
+	}
+	encode := func(c int, v float64) uint16 {
+		if v <= 0 {
+			return 0
+		}
+		if v >= 1 {
+			return to.encodeLUT[c][0xffff]
+		}
+		return to.encodeLUT[c][int(v*0xffff+0.5)]
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			r := float64(from.decodeLUT[0][c.R])
+			g := float64(from.decodeLUT[1][c.G])
+			bl := float64(from.decodeLUT[2][c.B])
+			dst.Set(x, y, color.NRGBA64{
+				R: encode(0, m[0]*r+m[1]*g+m[2]*bl),
+				G: encode(1, m[3]*r+m[4]*g+m[5]*bl),
+				B: encode(2, m[6]*r+m[7]*g+m[8]*bl),
+				A: c.A,
+			})
+		}
+	}
+	return dst
+}
+
+// restoreProfile converts rendered, made from work, the sRGB copy of
+// original, back to the profile of original. Pixels that rendering left
+// alone are taken from original, so they skip the clipped round trip
+// through sRGB and come out exactly as they went in.
+func restoreProfile(original, work, rendered image.Image, p *iccProfile) image.Image {
+	out := convertProfile(rendered, srgbProfile(), p).(draw.Image)
+	b := rendered.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r0, g0, b0, a0 := work.At(x, y).RGBA()
+			r1, g1, b1, a1 := rendered.At(x, y).RGBA()
+			if r0 == r1 && g0 == g1 && b0 == b1 && a0 == a1 {
+				out.Set(x, y, original.At(x, y))
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// decodeSRGB maps a 16-bit sRGB encoded value to linear light.
+var decodeSRGB [1 << 16]float32
+
+func init() {
+	for i := range decodeSRGB {
+		v := float64(i) / 0xffff
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		decodeSRGB[i] = float32(v)
+	}
+}
+
+// encodeSRGB maps a linear light value to a 16-bit sRGB encoded value.
+func encodeSRGB(v float32) uint16 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 1 {
+		return 0xffff
+	}
+	f := float64(v)
+	if f <= 0.0031308 {
+		f *= 12.92
+	} else {
+		f = 1.055*math.Pow(f, 1/2.4) - 0.055
+	}
+	return uint16(f*0xffff + 0.5)
+}
+
+// linearImage is an image in premultiplied linear light RGBA with float
+// samples, used as the working buffer for resampling and blending.
+type linearImage struct {
+	Pix    []float32
+	Stride int
+	Rect   image.Rectangle
+}
+
+func newLinearImage(r image.Rectangle) *linearImage {
+	return &linearImage{
+		Pix:    make([]float32, 4*r.Dx()*r.Dy()),
+		Stride: 4 * r.Dx(),
+		Rect:   r,
+	}
+}
+
+// toLinear converts img to linear light.
+func toLinear(img image.Image) *linearImage {
+	b := img.Bounds()
+	l := newLinearImage(b)
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			a := float32(c.A) / 0xffff
+			l.Pix[i+0] = decodeSRGB[c.R] * a
+			l.Pix[i+1] = decodeSRGB[c.G] * a
+			l.Pix[i+2] = decodeSRGB[c.B] * a
+			l.Pix[i+3] = a
+			i += 4
+		}
+	}
+	return l
+}
+
+// toSamples converts img to premultiplied float samples of its sRGB
+// encoded values, without going to linear light. It lets 16-bit images be
+// resampled and blurred like imaging does with 8-bit ones.
+func toSamples(img image.Image) *linearImage {
+	b := img.Bounds()
+	l := newLinearImage(b)
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			a := float32(c.A) / 0xffff
+			l.Pix[i+0] = float32(c.R) / 0xffff * a
+			l.Pix[i+1] = float32(c.G) / 0xffff * a
+			l.Pix[i+2] = float32(c.B) / 0xffff * a
+			l.Pix[i+3] = a
+			i += 4
+		}
+	}
+	return l
+}
+
+// samples is the inverse of toSamples.
+func (l *linearImage) samples() *image.NRGBA64 {
+	out := image.NewNRGBA64(l.Rect)
+	i := 0
+	for y := l.Rect.Min.Y; y < l.Rect.Max.Y; y++ {
+		for x := l.Rect.Min.X; x < l.Rect.Max.X; x++ {
+			a := l.Pix[i+3]
+			if a > 0 {
+				out.SetNRGBA64(x, y, color.NRGBA64{
+					R: uint16(clamp01(l.Pix[i+0]/a)*0xffff + 0.5),
+					G: uint16(clamp01(l.Pix[i+1]/a)*0xffff + 0.5),
+					B: uint16(clamp01(l.Pix[i+2]/a)*0xffff + 0.5),
+					A: uint16(clamp01(a)*0xffff + 0.5),
+				})
+			}
+			i += 4
+		}
+	}
+	return out
+}
+
+// nrgbaAt returns the sRGB encoded color of the pixel at (x, y).
+func (l *linearImage) nrgbaAt(x, y int) color.NRGBA64 {
+	i := (y-l.Rect.Min.Y)*l.Stride + (x-l.Rect.Min.X)*4
+	a := l.Pix[i+3]
+	if a <= 0 {
+		return color.NRGBA64{}
+	}
+	return color.NRGBA64{
+		R: encodeSRGB(l.Pix[i+0] / a),
+		G: encodeSRGB(l.Pix[i+1] / a),
+		B: encodeSRGB(l.Pix[i+2] / a),
+		A: uint16(math.Min(float64(a), 1)*0xffff + 0.5),
+	}
+}
+
+// nrgba64 encodes l back to sRGB.
+func (l *linearImage) nrgba64() *image.NRGBA64 {
+	out := image.NewNRGBA64(l.Rect)
+	for y := l.Rect.Min.Y; y < l.Rect.Max.Y; y++ {
+		for x := l.Rect.Min.X; x < l.Rect.Max.X; x++ {
+			out.SetNRGBA64(x, y, l.nrgbaAt(x, y))
+		}
+	}
+	return out
+}
+
+// lanczos3 is the Lanczos kernel with a support of three lobes.
+func lanczos3(x float64) float64 {
+	x = math.Abs(x)
+	if x == 0 {
+		return 1
+	}
+	if x >= 3 {
+		return 0
+	}
+	px := math.Pi * x
+	return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+}
+
+// resampleWeights computes, for each of the dst output samples, the first
+// contributing src sample and the normalized kernel weights.
+func resampleWeights(src, dst int) ([]int, [][]float32) {
+	scale := float64(src) / float64(dst)
+	support := 3 * math.Max(scale, 1)
+	starts := make([]int, dst)
+	weights := make([][]float32, dst)
+	for i := 0; i < dst; i++ {
+		center := (float64(i)+0.5)*scale - 0.5
+		lo := int(math.Ceil(center - support))
+		hi := int(math.Floor(center + support))
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > src-1 {
+			hi = src - 1
+		}
+		w := make([]float32, hi-lo+1)
+		var sum float64
+		for j := lo; j <= hi; j++ {
+			k := lanczos3((float64(j) - center) / math.Max(scale, 1))
+			w[j-lo] = float32(k)
+			sum += k
+		}
+		if sum != 0 {
+			for j := range w {
+				w[j] /= float32(sum)
+			}
+		}
+		starts[i] = lo
+		weights[i] = w
+	}
+	return starts, weights
+}
+
+// resizeLinear resamples l to w×h with a Lanczos filter, in linear light.
+func resizeLinear(l *linearImage, w, h int) *linearImage {
+	sw, sh := l.Rect.Dx(), l.Rect.Dy()
+
+	// Horizontal pass.
+	tmp := newLinearImage(image.Rect(0, 0, w, sh))
+	starts, weights := resampleWeights(sw, w)
+	for y := 0; y < sh; y++ {
+		row := l.Pix[y*l.Stride:]
+		for x := 0; x < w; x++ {
+			var r, g, b, a float32
+			for j, k := range weights[x] {
+				i := (starts[x] + j) * 4
+				r += row[i] * k
+				g += row[i+1] * k
+				b += row[i+2] * k
+				a += row[i+3] * k
+			}
+			o := y*tmp.Stride + x*4
+			tmp.Pix[o], tmp.Pix[o+1], tmp.Pix[o+2], tmp.Pix[o+3] = r, g, b, a
+		}
+	}
+
+	// Vertical pass.
+	out := newLinearImage(image.Rect(0, 0, w, h))
+	starts, weights = resampleWeights(sh, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var r, g, b, a float32
+			for j, k := range weights[y] {
+				i := (starts[y]+j)*tmp.Stride + x*4
+				r += tmp.Pix[i] * k
+				g += tmp.Pix[i+1] * k
+				b += tmp.Pix[i+2] * k
+				a += tmp.Pix[i+3] * k
+			}
+			// Lanczos rings, keep premultiplied samples in range.
+			a = clamp01(a)
+			o := y*out.Stride + x*4
+			out.Pix[o] = clampTo(r, a)
+			out.Pix[o+1] = clampTo(g, a)
+			out.Pix[o+2] = clampTo(b, a)
+			out.Pix[o+3] = a
+		}
+	}
+	return out
+}
+
+// blurLinear applies a gaussian blur of standard deviation sigma to l, with
+// the same kernel and edge handling as imaging.Blur.
+func blurLinear(l *linearImage, sigma float64) *linearImage {
+	if sigma <= 0 {
+		return l
+	}
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float32, 2*radius+1)
+	var sum float32
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = float32(math.Exp(-d * d / (2 * sigma * sigma)))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	w, h := l.Rect.Dx(), l.Rect.Dy()
+	pass := func(src *linearImage, dx, dy int) *linearImage {
+		out := newLinearImage(src.Rect)
+		n := w
+		if dy != 0 {
+			n = h
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				var c [4]float32
+				for k, weight := range kernel {
+					// Clamp to the edge like imaging.Blur.
+					p := x*dx + y*dy + k - radius
+					if p < 0 {
+						p = 0
+					} else if p > n-1 {
+						p = n - 1
+					}
+					sx, sy := x, y
+					if dx != 0 {
+						sx = p
+					} else {
+						sy = p
+					}
+					i := sy*src.Stride + sx*4
+					for j := range c {
+						c[j] += src.Pix[i+j] * weight
+					}
+				}
+				copy(out.Pix[y*out.Stride+x*4:], c[:])
+			}
+		}
+		return out
+	}
+	return pass(pass(l, 1, 0), 0, 1)
+}
+
+func clamp01(v float32) float32 {
+	return clampTo(v, 1)
+}
+
+func clampTo(v, max float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// resizeImage resizes img to w×h, in linear light if linear is set and
+// directly on the sRGB values otherwise. A zero w or h preserves the
+// aspect ratio, as with imaging.Resize. 16-bit images stay 16-bit.
+func resizeImage(img image.Image, w, h int, linear bool) image.Image {
+	if !linear && !isDeep(img) {
+		return imaging.Resize(img, w, h, imaging.Lanczos)
+	}
+	b := img.Bounds()
+	if b.Empty() || (w <= 0 && h <= 0) {
+		return image.NewNRGBA64(image.Rect(0, 0, 0, 0))
+	}
+	if w <= 0 {
+		w = int(float64(h)*float64(b.Dx())/float64(b.Dy()) + 0.5)
+	}
+	if h <= 0 {
+		h = int(float64(w)*float64(b.Dy())/float64(b.Dx()) + 0.5)
+	}
+	if w <= 0 || h <= 0 {
+		return image.NewNRGBA64(image.Rect(0, 0, 0, 0))
+	}
+	if !linear {
+		return resizeLinear(toSamples(img), w, h).samples()
+	}
+	return resizeLinear(toLinear(img), w, h).nrgba64()
+}
+
+// drawOver composites src over dst within r, like draw.DrawMask with
+// draw.Over. With linear set the blending happens in linear light.
+// mask may be nil.
+func drawOver(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point, mask image.Image, mp image.Point, linear bool) {
+	if !linear {
+		draw.DrawMask(dst, r, src, sp, mask, mp, draw.Over)
+		return
+	}
+	clip := r.Intersect(dst.Bounds())
+	clip = clip.Intersect(src.Bounds().Add(r.Min.Sub(sp)))
+	if mask != nil {
+		clip = clip.Intersect(mask.Bounds().Add(r.Min.Sub(mp)))
+	}
+	for y := clip.Min.Y; y < clip.Max.Y; y++ {
+		for x := clip.Min.X; x < clip.Max.X; x++ {
+			s := color.NRGBA64Model.Convert(src.At(x-r.Min.X+sp.X, y-r.Min.Y+sp.Y)).(color.NRGBA64)
+			sa := float32(s.A) / 0xffff
+			if mask != nil {
+				_, _, _, ma := mask.At(x-r.Min.X+mp.X, y-r.Min.Y+mp.Y).RGBA()
+				sa *= float32(ma) / 0xffff
+			}
+			if sa == 0 {
+				continue
+			}
+			d := color.NRGBA64Model.Convert(dst.At(x, y)).(color.NRGBA64)
+			da := float32(d.A) / 0xffff * (1 - sa)
+			a := sa + da
+			blend := func(s, d uint16) uint16 {
+				return encodeSRGB((decodeSRGB[s]*sa + decodeSRGB[d]*da) / a)
+			}
+			dst.Set(x, y, color.NRGBA64{
+				R: blend(s.R, d.R),
+				G: blend(s.G, d.G),
+				B: blend(s.B, d.B),
+				A: uint16(a*0xffff + 0.5),
+			})
+		}
+	}
+}
@@ -1,28 +1,149 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"image"
-	"image/draw"
-	"image/png"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"time"
 
 	"cloud.google.com/go/vision/apiv1"
-	"github.com/disintegration/imaging"
-	"github.com/paulvasilenko/go-transcolor"
 	"golang.org/x/net/context"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
 )
 
 var facesDir = flag.String("faces", "faces", "The directory to search for faces.")
+var nmsThreshold = flag.Float64("nms", 0.5, "Drop detections overlapping a more confident one by more than this IoU (0 disables).")
+var headScale = flag.Float64("head-scale", 1, "Scale pasted faces relative to the detected box, anchored at the chin (e.g. 1.5 for big heads).")
+var matchQualityFlag = flag.Bool("match-quality", true, "Match the blur, noise and resolution of pasted faces to the photo.")
+var adaptLikelihoods = flag.Bool("adapt-likelihoods", true, "Blur or darken pasted faces when Vision reports the original as blurred or under-exposed.")
+var preserveOcclusions = flag.Bool("preserve-occlusions", false, "Keep hats and glasses of the original faces on top of the pasted ones.")
+var colorTransfer = flag.Bool("color-transfer", true, "Match the colors of pasted faces to the faces they replace.")
+var linearLight = flag.Bool("linear", true, "Resize and blend in linear light; -linear=false works directly on sRGB values.")
+var outputPath = flag.String("output", "", "The file to write the result to, stdout if empty.")
+var outputFormat = flag.String("format", "", "Output format: jpeg, png, gif, tiff, bmp or ora. Inferred from -output, PNG otherwise.")
+var jpegQuality = flag.Int("quality", 90, "JPEG output quality, 1 to 100.")
+var pngCompression = flag.String("png-compression", "default", "PNG compression level: default, none, fast or best.")
+var colorManage = flag.Bool("color-manage", true, "Convert inputs and library faces with an embedded ICC profile to sRGB before processing.")
+var outputProfile = flag.String("output-profile", "original", "Color profile of the output when the input had one: \"original\" or \"srgb\".")
+var videoMode = flag.Bool("video", false, "Read a YUV4MPEG2 video from the input, or stdin, and write the chrisified video.")
+var mjpegURL = flag.String("mjpeg", "", "Read an MJPEG stream from this URL and republish it chrisified on -listen.")
+var listenAddr = flag.String("listen", "localhost:8080", "The address to serve the chrisified MJPEG stream on.")
+var detectInterval = flag.Duration("detect-interval", time.Second, "For MJPEG streams, the minimum time between face detections.")
+var detectEvery = flag.Int("detect-every", 1, "For animations and video, run face detection on every Nth frame and track faces in between.")
+var smoothing = flag.Float64("smoothing", 0.5, "For animations and video, weight of each new detection when smoothing tracked faces, 1 disables smoothing.")
+var stripMetadata = flag.String("strip-metadata", "", "Drop metadata from the output: \"all\", or \"gps\" for the location only.")
+var maskOut = flag.String("mask-out", "", "Also write a grayscale PNG of how much of each pixel was replaced to this file.")
+var maskLabels = flag.Bool("mask-labels", false, "Write -mask-out as an indexed label map of face numbers instead, 0 where no face was pasted.")
+var debugOverlay = flag.Bool("debug-overlay", false, "Draw the detected boxes, landmarks, angles and assigned library faces on the output.")
+var compareMode = flag.String("compare", "", "Write a before/after comparison: \"horizontal\" or \"vertical\" side by side, \"html\" with a draggable split, or a \"flipbook\" GIF.")
+var assignFaces = flag.String("assign", "", "Comma separated library files to use for the detected faces, in order. Faces without one are assigned randomly.")
+var variations = flag.Int("variations", 9, "For chrisify sheet, the number of variations to render.")
+var tileWidth = flag.Int("tile-width", 400, "For chrisify sheet, the width of every tile.")
+var seedFlag = flag.Int64("seed", 0, "Seed for the random choices, 0 picks one. Runs with the same seed and input render the same.")
+var recipePath = flag.String("recipe", "", "Also write the render recipe as JSON to this file. PNG output embeds it unless --strip-metadata all is given.")
+var tileSize = flag.Int("tile-size", 32, "For chrisify mosaic, the size of every tile in pixels.")
+var maxRepeats = flag.Int("max-repeats", 0, "For chrisify mosaic, how often a face may be used, 0 for no limit.")
+var mosaicTint = flag.Bool("tint", false, "For chrisify mosaic, tint every face with the colors of the tile it replaces.")
+var templatesDir = flag.String("templates", "templates", "For chrisify reverse, the directory of template photos and their manifest.json.")
+var templateName = flag.String("template", "", "For chrisify reverse, the template photo to use, a random one if empty.")
+var faceMode = flag.String("mode", "replace", "\"replace\" puts library faces on the detected faces, \"swap\" rotates the detected faces among themselves.")
+var gcsStaging = flag.String("gcs-staging", "", "For multi-page TIFFs, a gs://bucket/prefix to stage the file in for Vision's asynchronous file annotation, which detects all pages at once. Pages are detected one by one without it.")
+var exportLayers = flag.Bool("export-layers", false, "Write an OpenRaster (.ora) file with the photo and every pasted face as separate layers.")
+
+func init() {
+	flag.StringVar(outputPath, "o", "", "Shorthand for -output.")
+}
 
 func main() {
-	rand.Seed(time.Now().UTC().UnixNano())
 	flag.Parse()
 
-	var err error
+	// Subcommands take the same flags, before or after their name.
+	command := ""
+	switch flag.Arg(0) {
+	case "sheet", "rerender", "mosaic", "reverse":
+		command = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	// Replay a recipe, from a JSON file or a PNG output, on the input.
+	var rec *recipe
+	if command == "rerender" {
+		r, err := loadRecipe(flag.Arg(0))
+		if err != nil {
+			log.Fatalf("error loading recipe %s: %s", flag.Arg(0), err)
+		}
+		rec = &r
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	// Flags given on the command line override the recipe.
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	seed := *seedFlag
+	if rec != nil && !given["seed"] {
+		seed = rec.Seed
+	}
+	if seed == 0 {
+		seed = time.Now().UTC().UnixNano()
+	}
+	rand.Seed(seed)
+
+	mode := *faceMode
+	if rec != nil && !given["mode"] {
+		mode = rec.Mode
+		if mode == "" {
+			mode = "replace"
+		}
+	}
+	swap := false
+	switch mode {
+	case "replace":
+	case "swap":
+		swap = true
+		if command == "mosaic" || command == "reverse" || *videoMode || *mjpegURL != "" {
+			panic("-mode=swap only works on still images")
+		}
+	default:
+		panic("unknown -mode " + mode)
+	}
+
+	format := *outputFormat
+	if *exportLayers {
+		format = "ora"
+	}
+	switch *compareMode {
+	case "", "horizontal", "vertical":
+	case "html":
+		format = "html"
+	case "flipbook":
+		format = "gif"
+	default:
+		panic("unknown -compare mode " + *compareMode)
+	}
+	encodeOpts, err := outputOptions(*outputPath, format, *jpegQuality, *pngCompression)
+	if err != nil {
+		panic(err)
+	}
+	// HTML pages and OpenRaster layers only exist for a single rendered
+	// image, check before anything is sent to Vision.
+	if encodeOpts.format == "html" && *compareMode != "html" {
+		panic("html output needs --compare html")
+	}
+	if (encodeOpts.format == "ora" || encodeOpts.format == "html") && command != "" && command != "rerender" {
+		panic(encodeOpts.format + " output is not supported for chrisify " + command)
+	}
+
 	var facesPath string
 
 	if *facesDir != "" {
@@ -32,86 +153,372 @@ func main() {
 		}
 	}
 
+	// Swapped faces come from the input itself.
 	chrisFaces := FaceList{}
-	err = chrisFaces.Load(facesPath)
-	if err != nil {
-		panic(err)
-	}
-	if len(chrisFaces) == 0 {
-		panic("no faces found")
+	if !swap {
+		err = chrisFaces.Load(facesPath, *colorManage)
+		if err != nil {
+			panic(err)
+		}
+		if len(chrisFaces) == 0 {
+			panic("no faces found")
+		}
 	}
 	file := flag.Arg(0)
-	baseImage := loadImage(file)
+
+	opts := renderOptions{
+		headScale: *headScale,
+		nms:       *nmsThreshold,
+		composite: compositeOptions{
+			matchQuality:       *matchQualityFlag,
+			adaptLikelihoods:   *adaptLikelihoods,
+			preserveOcclusions: *preserveOcclusions,
+			linear:             *linearLight,
+			colorTransfer:      *colorTransfer,
+		},
+	}
+	if rec != nil {
+		opts = rec.Settings.options(opts, given)
+	}
+
+	switch {
+	case *mjpegURL != "":
+		rejectImageFlags(given, "MJPEG streams")
+	case *videoMode:
+		rejectImageFlags(given, "video")
+	case command == "sheet":
+		// The sheet still renders the detected faces in order.
+		rejectImageFlags(given, "chrisify sheet", "assign")
+	case command == "mosaic" || command == "reverse":
+		rejectImageFlags(given, "chrisify "+command)
+	}
 
 	ctx := context.Background()
 
-	client, err := vision.NewImageAnnotatorClient(ctx)
+	// Recipes carry their detections and mosaics need none, only the
+	// other modes need a client.
+	var client *vision.ImageAnnotatorClient
+	if command != "rerender" && command != "mosaic" {
+		client, err = vision.NewImageAnnotatorClient(ctx)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *mjpegURL != "" {
+		detect := func(img image.Image) ([]*pb.FaceAnnotation, error) {
+			return detectImage(ctx, client, img)
+		}
+		err := serveMJPEG(ctx, *mjpegURL, *listenAddr, detect, chrisFaces, opts, *detectInterval, *smoothing, *jpegQuality)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if *videoMode {
+		in := os.Stdin
+		if file != "" && file != "-" {
+			in, err = os.Open(file)
+			if err != nil {
+				log.Fatalf("error loading %s: %s", file, err)
+			}
+			defer in.Close()
+		}
+		err := writeFile(*outputPath, func(w io.Writer) error {
+			return chrisifyY4M(ctx, client, in, w, chrisFaces, opts, *detectEvery, *smoothing)
+		})
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	data := loadImage(file)
+
+	// Animated GIFs stay animated unless another output format was asked for.
+	toStdout := *outputPath == "" || *outputPath == "-"
+	if isGIF(data) && command == "" && !swap && *compareMode == "" && (encodeOpts.format == "gif" || (toStdout && *outputFormat == "")) {
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			log.Fatalf("error loading %s: %s", file, err)
+		}
+		if len(anim.Image) > 1 {
+			rejectImageFlags(given, "animated GIFs, use --format png for the first frame")
+			out, err := chrisifyGIF(ctx, client, anim, chrisFaces, opts, *detectEvery, *smoothing)
+			if err != nil {
+				panic(err)
+			}
+			if err := writeAnimation(*outputPath, out); err != nil {
+				panic(err)
+			}
+			return
+		}
+	}
+
+	if isPDF(data) {
+		log.Fatalf("error loading %s: PDF documents are not supported, convert the pages to a multi-page TIFF first", file)
+	}
+
+	// Multi-page TIFFs are processed page by page when written to a TIFF or
+	// to a directory of pages.
+	toDir := isDir(*outputPath)
+	if isTIFF(data) && command == "" && !swap && (toDir || len(tiffPages(data)) > 1 && (encodeOpts.format == "tiff" || (toStdout && *outputFormat == ""))) {
+		rejectImageFlags(given, "multi-page TIFFs, use --format png for the first page")
+		if encodeOpts.format == "ora" {
+			log.Fatalf("ora output is not supported for multi-page TIFFs, use --format png for the first page")
+		}
+		pages, meta, err := decodeTIFFPages(data)
+		if err != nil {
+			log.Fatalf("error loading %s: %s", file, err)
+		}
+		// Every output gets the metadata of the first page.
+		encodeOpts.meta = keptMetadata(&meta, *stripMetadata)
+		rejectLostMetadata(encodeOpts.format, encodeOpts.meta, file)
+		var detected [][]*pb.FaceAnnotation
+		if *gcsStaging != "" {
+			stage, err := parseGCSLocation(*gcsStaging)
+			if err != nil {
+				panic(err)
+			}
+			gcs, err := newGCSClient(ctx)
+			if err != nil {
+				panic(err)
+			}
+			detected, err = detectDocument(ctx, client, gcs, stage, data)
+			if err != nil {
+				panic(err)
+			}
+		}
+		pages, err = chrisifyDocument(ctx, client, pages, detected, chrisFaces, opts)
+		if err != nil {
+			panic(err)
+		}
+		if toDir {
+			err = writePages(*outputPath, pages, encodeOpts)
+		} else {
+			err = writeFile(*outputPath, func(w io.Writer) error {
+				doc, err := encodeTIFFPages(pages)
+				if err == nil && encodeOpts.meta != nil {
+					doc, err = embedTIFFMetadata(doc, *encodeOpts.meta)
+				}
+				if err != nil {
+					return err
+				}
+				_, err = w.Write(doc)
+				return err
+			})
+		}
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	baseImage, orient, meta, err := decodeImage(data)
 	if err != nil {
-		panic(err)
+		log.Fatalf("error loading %s: %s", file, err)
+	}
+	encodeOpts.meta = keptMetadata(&meta, *stripMetadata)
+
+	var profile *iccProfile
+	if *colorManage && meta.icc != nil {
+		profile, err = parseICC(meta.icc)
+		if err != nil {
+			log.Printf("ignoring color profile of %s: %s", file, err)
+			profile = nil
+		}
+	}
+	keep := false
+	switch *outputProfile {
+	case "original":
+		// The profile can only travel along in formats that embed it.
+		keep = encodeOpts.meta != nil && (encodeOpts.format == "jpeg" || encodeOpts.format == "png" || encodeOpts.format == "tiff")
+	case "srgb":
+	default:
+		panic("unknown -output-profile " + *outputProfile)
+	}
+	if profile != nil && !keep {
+		baseImage = convertProfile(baseImage, profile, srgbProfile())
+		profile = nil
+	}
+	if profile == nil {
+		// Untagged output is read as sRGB.
+		meta.icc = nil
+	}
+	rejectLostMetadata(encodeOpts.format, encodeOpts.meta, file)
+
+	// A photo whose profile goes to the output is worked on in sRGB like
+	// any other; afterwards only the pixels that changed are converted
+	// back, see restoreProfile.
+	original := baseImage
+	if profile != nil {
+		baseImage = convertProfile(baseImage, profile, srgbProfile())
 	}
 
-	f, err := os.Open(file)
+	if command == "mosaic" {
+		stats := libraryStats(facesPath, chrisFaces)
+		var result image.Image = mosaic(baseImage, chrisFaces, stats, *tileSize, *maxRepeats, *mosaicTint)
+		if profile != nil {
+			result = convertProfile(result, srgbProfile(), profile)
+		}
+		if err := writeOutput(*outputPath, result, encodeOpts); err != nil {
+			panic(err)
+		}
+		return
+	}
 
+	bounds := baseImage.Bounds()
+
+	var faces []*pb.FaceAnnotation
+	var assign []int
+	if rec != nil {
+		if rec.Input != inputHash(data) {
+			log.Printf("warning: %s is not the input the recipe was made from", file)
+		}
+		faces = rec.detections()
+		if swap {
+			chrisFaces = cutFaces(baseImage, faces)
+		}
+		chrisFaces, assign, err = rec.assignment(chrisFaces)
+		if err == nil {
+			err = overrideAssignment(assign, *assignFaces, chrisFaces)
+		}
+	} else {
+		faces, err = detectFaces(ctx, client, data)
+		if err != nil {
+			panic(err)
+		}
+
+		// Vision sees the stored pixels, move its coordinates upright too.
+		if orient.swapsAxes() {
+			orient.faces(faces, bounds.Dy(), bounds.Dx())
+		} else {
+			orient.faces(faces, bounds.Dx(), bounds.Dy())
+		}
+		faces = suppressDuplicates(faces, opts.nms)
+
+		if command == "reverse" {
+			// The input's faces go onto a template photo instead.
+			templates, err := loadManifest(*templatesDir)
+			if err != nil {
+				panic(err)
+			}
+			t, err := pickTemplate(templates, *templateName)
+			if err != nil {
+				panic(err)
+			}
+			file := filepath.Join(*templatesDir, t.File)
+			template, _, tmeta, err := decodeImage(loadImage(file))
+			if err != nil {
+				log.Fatalf("error loading %s: %s", file, err)
+			}
+			if *colorManage && tmeta.icc != nil {
+				if p, err := parseICC(tmeta.icc); err == nil {
+					template = convertProfile(template, p, srgbProfile())
+				}
+			}
+			result := reverse(baseImage, faces, template, t, opts)
+			if err := writeOutput(*outputPath, result, encodeOptions{format: encodeOpts.format, jpegQuality: encodeOpts.jpegQuality, pngCompression: encodeOpts.pngCompression}); err != nil {
+				panic(err)
+			}
+			return
+		}
+
+		if swap {
+			if len(faces) < 2 {
+				log.Printf("fewer than two faces in %s, nothing to swap", file)
+				faces = nil
+			}
+			chrisFaces = cutFaces(baseImage, faces)
+			assign = swapAssignment(len(faces))
+			err = overrideAssignment(assign, *assignFaces, chrisFaces)
+		} else {
+			assign, err = parseAssignment(*assignFaces, len(faces), chrisFaces)
+		}
+	}
 	if err != nil {
 		panic(err)
 	}
 
-	defer f.Close()
+	// Reseed so the rendering itself only depends on the seed, not on how
+	// the faces were assigned.
+	rand.Seed(seed)
 
-	imageToDetect, err := vision.NewImageFromReader(f)
-
-	faces, err := client.DetectFaces(ctx, imageToDetect, nil, 100)
+	if command == "sheet" {
+		var result image.Image = contactSheet(baseImage, faces, chrisFaces, assign, opts, *variations, *tileWidth)
+		if profile != nil {
+			result = convertProfile(result, srgbProfile(), profile)
+		}
+		if err := writeOutput(*outputPath, result, encodeOpts); err != nil {
+			panic(err)
+		}
+		return
+	}
 
+	canvas, layers := renderLayers(baseImage, faces, chrisFaces, assign, opts)
+	recipeJSON, err := json.MarshalIndent(newRecipe(data, seed, mode, faces, assign, chrisFaces, opts), "", "  ")
 	if err != nil {
 		panic(err)
 	}
+	meta.recipe = recipeJSON
+	if *recipePath != "" {
+		if err := ioutil.WriteFile(*recipePath, append(recipeJSON, '\n'), 0644); err != nil {
+			panic(err)
+		}
+	}
+	if *maskOut != "" {
+		var mask image.Image = blendMask(bounds, layers)
+		if *maskLabels {
+			mask = labelMap(bounds, layers)
+		}
+		if err := writeOutput(*maskOut, mask, encodeOptions{format: "png"}); err != nil {
+			panic(err)
+		}
+	}
+	if encodeOpts.format == "ora" {
+		err := writeFile(*outputPath, func(w io.Writer) error {
+			return writeORA(w, baseImage, canvas, layers)
+		})
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
 
-	bounds := baseImage.Bounds()
+	if *debugOverlay {
+		names := make([]string, len(faces))
+		for i := range faces {
+			names[i] = chrisFaces[assign[i]].Name
+		}
+		drawDebugOverlay(canvas, faces, names)
+	}
+
+	switch *compareMode {
+	case "html":
+		err := writeFile(*outputPath, func(w io.Writer) error {
+			return writeCompareHTML(w, baseImage, canvas, *jpegQuality)
+		})
+		if err != nil {
+			panic(err)
+		}
+		return
+	case "flipbook":
+		if err := writeAnimation(*outputPath, flipbook(baseImage, canvas)); err != nil {
+			panic(err)
+		}
+		return
+	}
 
-	canvas := canvasFromImage(baseImage)
-
-	numberList := rand.Perm(len(chrisFaces))
-
-	for i, face := range faces {
-		rect := image.Rect(
-			int(face.BoundingPoly.Vertices[0].X),
-			int(face.BoundingPoly.Vertices[0].Y),
-			int(face.BoundingPoly.Vertices[2].X),
-			int(face.BoundingPoly.Vertices[2].Y))
-		newFace := chrisFaces[numberList[i%len(chrisFaces)]]
-		if newFace == nil {
-			panic("nil face")
-		}
-		draw.Draw(
-			canvas,
-			rect,
-			transcolor.Transfer(
-				canvasFromImage(baseImage).SubImage(rect),
-				imaging.Resize(
-					newFace, rect.Dx(), rect.Dy(), imaging.Lanczos,
-				),
-			),
-			bounds.Min,
-			draw.Over,
-		)
-	}
-
-	if len(faces) == 0 {
-		face := imaging.Resize(
-			chrisFaces[0],
-			bounds.Dx()/3,
-			0,
-			imaging.Lanczos,
-		)
-		faceBounds := face.Bounds()
-		draw.Draw(
-			canvas,
-			bounds,
-			face,
-			bounds.Min.Add(image.Pt(-bounds.Max.X/2+faceBounds.Max.X/2, -bounds.Max.Y+int(float64(faceBounds.Max.Y)/1.9))),
-			draw.Over,
-		)
-	}
-
-	png.Encode(os.Stdout, canvas)
+	var result image.Image = canvas
+	if profile != nil {
+		result = restoreProfile(original, baseImage, canvas, profile)
+		baseImage = original
+	}
+	if *compareMode != "" {
+		result = sideBySide(baseImage, result, *compareMode == "vertical")
+	}
+	if err := writeOutput(*outputPath, result, encodeOpts); err != nil {
+		panic(err)
+	}
 }
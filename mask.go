@@ -0,0 +1,83 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// labelPeeking labels the peeking face, which is not a detection.
+const labelPeeking = 255
+
+// blendMask returns how much of every pixel of the output was replaced by
+// pasted faces, as the combined coverage of the layers.
+func blendMask(bounds image.Rectangle, layers []layer) *image.Gray {
+	mask := image.NewGray(bounds)
+	for _, l := range layers {
+		r := l.img.Rect.Intersect(bounds)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				a := uint32(l.img.NRGBAAt(x, y).A)
+				if a == 0 {
+					continue
+				}
+				i := mask.PixOffset(x, y)
+				d := uint32(mask.Pix[i])
+				mask.Pix[i] = uint8(a + d*(0xff-a)/0xff)
+			}
+		}
+	}
+	return mask
+}
+
+// labelMap returns an indexed image where every pixel holds the number of
+// the topmost face covering it: 0 for untouched pixels, n for the nth
+// detected face and labelPeeking for the peeking face.
+func labelMap(bounds image.Rectangle, layers []layer) *image.Paletted {
+	labels := image.NewPaletted(bounds, labelPalette())
+	for _, l := range layers {
+		label := uint8(l.index + 1)
+		if l.index < 0 || l.index+1 >= labelPeeking {
+			label = labelPeeking
+		}
+		r := l.img.Rect.Intersect(bounds)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if l.img.NRGBAAt(x, y).A != 0 {
+					labels.SetColorIndex(x, y, label)
+				}
+			}
+		}
+	}
+	return labels
+}
+
+// labelPalette gives the labels colors that are easy to tell apart when
+// the map is viewed as an image: black for no face, white for the peeking
+// face and hues spaced by the golden angle for the detections.
+func labelPalette() color.Palette {
+	p := make(color.Palette, 256)
+	p[0] = color.Gray{}
+	for i := 1; i < labelPeeking; i++ {
+		h := math.Mod(float64(i)*137.508, 360) / 60
+		x := uint8(255 * (1 - math.Abs(math.Mod(h, 2)-1)))
+		var c color.RGBA
+		switch int(h) {
+		case 0:
+			c = color.RGBA{255, x, 0, 255}
+		case 1:
+			c = color.RGBA{x, 255, 0, 255}
+		case 2:
+			c = color.RGBA{0, 255, x, 255}
+		case 3:
+			c = color.RGBA{0, x, 255, 255}
+		case 4:
+			c = color.RGBA{x, 0, 255, 255}
+		default:
+			c = color.RGBA{255, 0, x, 255}
+		}
+		p[i] = c
+	}
+	p[labelPeeking] = color.Gray{0xff}
+	return p
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+)
+
+// metadata is what gets carried over from the input file to the output.
+type metadata struct {
+	// exif is the TIFF structured EXIF block, without the "Exif" header.
+	exif []byte
+	// icc is the embedded ICC color profile.
+	icc []byte
+	// dpiX and dpiY are the pixel densities in dots per inch, zero if
+	// unknown.
+	dpiX, dpiY float64
+	// recipe is the render recipe as JSON, only written to PNG output.
+	recipe []byte
+}
+
+var iccHeader = []byte("ICC_PROFILE\x00")
+
+// readMetadata extracts EXIF, ICC and density from an encoded JPEG, PNG,
+// TIFF or WebP.
+func readMetadata(data []byte) metadata {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return readPNGMetadata(data)
+	case isTIFF(data):
+		return readTIFFMetadata(data)
+	case isWebP(data):
+		return metadata{exif: webpEXIF(data), icc: webpChunk(data, "ICCP")}
+	}
+	var m metadata
+	var icc [][]byte
+	for _, seg := range jpegSegments(data) {
+		switch {
+		case seg.marker == 0xe0 && bytes.HasPrefix(seg.data, []byte("JFIF\x00")) && len(seg.data) >= 12:
+			x := float64(binary.BigEndian.Uint16(seg.data[8:]))
+			y := float64(binary.BigEndian.Uint16(seg.data[10:]))
+			switch seg.data[7] {
+			case 1:
+				m.dpiX, m.dpiY = x, y
+			case 2:
+				m.dpiX, m.dpiY = x*2.54, y*2.54
+			}
+		case seg.marker == 0xe1 && bytes.HasPrefix(seg.data, exifHeader):
+			m.exif = append([]byte(nil), seg.data[len(exifHeader):]...)
+		case seg.marker == 0xe2 && bytes.HasPrefix(seg.data, iccHeader) && len(seg.data) > len(iccHeader)+2:
+			// Profiles larger than a segment are split into numbered chunks.
+			seq, count := int(seg.data[len(iccHeader)]), int(seg.data[len(iccHeader)+1])
+			if icc == nil {
+				icc = make([][]byte, count)
+			}
+			if seq >= 1 && seq <= len(icc) {
+				icc[seq-1] = seg.data[len(iccHeader)+2:]
+			}
+		}
+	}
+	for _, chunk := range icc {
+		if chunk == nil {
+			return m
+		}
+	}
+	m.icc = bytes.Join(icc, nil)
+	return m
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngChunk is a chunk of a PNG file.
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// pngChunks splits an encoded PNG into its chunks.
+func pngChunks(data []byte) []pngChunk {
+	var chunks []pngChunk
+	i := len(pngSignature)
+	for i+12 <= len(data) {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		if n < 0 || i+12+n > len(data) {
+			break
+		}
+		chunks = append(chunks, pngChunk{typ: string(data[i+4 : i+8]), data: data[i+8 : i+8+n]})
+		i += 12 + n
+	}
+	return chunks
+}
+
+func readPNGMetadata(data []byte) metadata {
+	var m metadata
+	for _, c := range pngChunks(data) {
+		switch c.typ {
+		case "eXIf":
+			m.exif = append([]byte(nil), c.data...)
+		case "iCCP":
+			// Profile name, a null separator, the compression method and
+			// the zlib compressed profile.
+			i := bytes.IndexByte(c.data, 0)
+			if i < 0 || i+2 > len(c.data) {
+				continue
+			}
+			r, err := zlib.NewReader(bytes.NewReader(c.data[i+2:]))
+			if err != nil {
+				continue
+			}
+			if icc, err := ioutil.ReadAll(r); err == nil {
+				m.icc = icc
+			}
+		case "pHYs":
+			if len(c.data) == 9 && c.data[8] == 1 {
+				// Pixels per meter.
+				m.dpiX = float64(binary.BigEndian.Uint32(c.data)) * 0.0254
+				m.dpiY = float64(binary.BigEndian.Uint32(c.data[4:])) * 0.0254
+			}
+		}
+	}
+	return m
+}
+
+const (
+	tagXResolution    = 0x011a
+	tagYResolution    = 0x011b
+	tagResolutionUnit = 0x0128
+	tagICCProfile     = 0x8773
+)
+
+func readTIFFMetadata(data []byte) metadata {
+	m := metadata{exif: tiffEXIF(data)}
+	entries, _ := tiffIFD(data, tiffFirstIFD(data))
+	order := tiffByteOrder(data)
+	inch := 1.0
+	var x, y float64
+	rational := func(e tiffEntry) float64 {
+		v := entryData(data, e)
+		if e.typ != 5 || len(v) < 8 || order.Uint32(v[4:]) == 0 {
+			return 0
+		}
+		return float64(order.Uint32(v)) / float64(order.Uint32(v[4:]))
+	}
+	for _, e := range entries {
+		switch e.tag {
+		case tagICCProfile:
+			m.icc = append([]byte(nil), entryData(data, e)...)
+		case tagXResolution:
+			x = rational(e)
+		case tagYResolution:
+			y = rational(e)
+		case tagResolutionUnit:
+			switch order.Uint16(e.value) {
+			case 1:
+				// No absolute unit.
+				inch = 0
+			case 3:
+				inch = 2.54
+			}
+		}
+	}
+	m.dpiX, m.dpiY = x*inch, y*inch
+	if len(m.icc) == 0 {
+		m.icc = nil
+	}
+	return m
+}
+
+// embedMetadata adds m to an encoded image in the given format. Formats
+// without metadata support are returned unchanged, see lostMetadata.
+func embedMetadata(data []byte, format string, m metadata) ([]byte, error) {
+	switch format {
+	case "jpeg":
+		return embedJPEGMetadata(data, m)
+	case "", "png":
+		return embedPNGMetadata(data, m)
+	case "tiff":
+		return embedTIFFMetadata(data, m)
+	case "bmp":
+		return embedBMPMetadata(data, m)
+	}
+	return data, nil
+}
+
+// lostMetadata lists the parts of m that the given format cannot hold.
+func lostMetadata(format string, m metadata) []string {
+	var lost []string
+	switch format {
+	case "gif", "bmp":
+		if len(m.exif) > 0 {
+			lost = append(lost, "EXIF")
+		}
+		if len(m.icc) > 0 {
+			lost = append(lost, "color profile")
+		}
+	}
+	if format == "gif" && m.dpiX > 0 && m.dpiY > 0 {
+		lost = append(lost, "resolution")
+	}
+	return lost
+}
+
+func jpegSegmentBytes(marker byte, payload []byte) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+func embedJPEGMetadata(data []byte, m metadata) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, fmt.Errorf("not a JPEG stream")
+	}
+	var head bytes.Buffer
+	head.Write(data[:2])
+	if m.dpiX > 0 && m.dpiY > 0 {
+		jfif := []byte("JFIF\x00\x01\x02\x01\x00\x00\x00\x00\x00\x00")
+		binary.BigEndian.PutUint16(jfif[8:], uint16(m.dpiX+0.5))
+		binary.BigEndian.PutUint16(jfif[10:], uint16(m.dpiY+0.5))
+		head.Write(jpegSegmentBytes(0xe0, jfif))
+	}
+	if len(m.exif) > 0 {
+		if len(exifHeader)+len(m.exif) > 0xffff-2 {
+			return nil, fmt.Errorf("EXIF block too large for a JPEG segment")
+		}
+		head.Write(jpegSegmentBytes(0xe1, append(append([]byte(nil), exifHeader...), m.exif...)))
+	}
+	if len(m.icc) > 0 {
+		const chunkSize = 0xffff - 2 - 14
+		count := (len(m.icc) + chunkSize - 1) / chunkSize
+		if count > 255 {
+			return nil, fmt.Errorf("ICC profile too large for JPEG")
+		}
+		for i := 0; i < count; i++ {
+			end := (i + 1) * chunkSize
+			if end > len(m.icc) {
+				end = len(m.icc)
+			}
+			payload := append(append([]byte(nil), iccHeader...), byte(i+1), byte(count))
+			head.Write(jpegSegmentBytes(0xe2, append(payload, m.icc[i*chunkSize:end]...)))
+		}
+	}
+	return append(head.Bytes(), data[2:]...), nil
+}
+
+func pngChunkBytes(typ string, payload []byte) []byte {
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, payload...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+func embedPNGMetadata(data []byte, m metadata) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) || len(data) < len(pngSignature)+25 {
+		return nil, fmt.Errorf("not a PNG stream")
+	}
+	// The IHDR chunk always comes first and is 25 bytes long.
+	split := len(pngSignature) + 25
+	var extra bytes.Buffer
+	if len(m.icc) > 0 {
+		var z bytes.Buffer
+		w := zlib.NewWriter(&z)
+		w.Write(m.icc)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		extra.Write(pngChunkBytes("iCCP", append([]byte("ICC profile\x00\x00"), z.Bytes()...)))
+	}
+	if m.dpiX > 0 && m.dpiY > 0 {
+		phys := make([]byte, 9)
+		binary.BigEndian.PutUint32(phys, uint32(m.dpiX/0.0254+0.5))
+		binary.BigEndian.PutUint32(phys[4:], uint32(m.dpiY/0.0254+0.5))
+		phys[8] = 1
+		extra.Write(pngChunkBytes("pHYs", phys))
+	}
+	if len(m.exif) > 0 {
+		extra.Write(pngChunkBytes("eXIf", m.exif))
+	}
+	if len(m.recipe) > 0 {
+		extra.Write(pngTextChunk(recipeKeyword, m.recipe))
+	}
+	out := append([]byte(nil), data[:split]...)
+	out = append(out, extra.Bytes()...)
+	return append(out, data[split:]...), nil
+}
+
+// embedTIFFMetadata rewrites the first directory of an encoded TIFF with
+// the resolution, the ICC profile and the descriptive EXIF tags of m. The
+// new directory is appended to the file, links to the following pages
+// are kept.
+func embedTIFFMetadata(data []byte, m metadata) ([]byte, error) {
+	if !isTIFF(data) {
+		return nil, fmt.Errorf("not a TIFF stream")
+	}
+	order := tiffByteOrder(data)
+	entries, next := tiffIFD(data, tiffFirstIFD(data))
+	if entries == nil {
+		return nil, fmt.Errorf("bad TIFF directory")
+	}
+	var exif tiffDir
+	var subs map[uint16]tiffDir
+	if isTIFF(m.exif) {
+		from := tiffByteOrder(m.exif)
+		exif, subs = photoDirs(m.exif)
+		exif = reorderDir(exif, from, order)
+		for tag, d := range subs {
+			subs[tag] = reorderDir(d, from, order)
+		}
+	}
+
+	replaced := func(tag uint16) bool {
+		switch tag {
+		case tagXResolution, tagYResolution, tagResolutionUnit:
+			return m.dpiX > 0 && m.dpiY > 0
+		case tagICCProfile:
+			return len(m.icc) > 0
+		case tagEXIFIFD, tagGPSIFD:
+			return true
+		}
+		return photoTags[tag] && len(exif.entries) > 0
+	}
+	var dir tiffDir
+	for _, e := range entries {
+		if !replaced(e.tag) {
+			dir.entries = append(dir.entries, e)
+			dir.values = append(dir.values, entryData(data, e))
+		}
+	}
+	dir.entries = append(dir.entries, exif.entries...)
+	dir.values = append(dir.values, exif.values...)
+	if m.dpiX > 0 && m.dpiY > 0 {
+		rational := func(dpi float64) []byte {
+			v := make([]byte, 8)
+			order.PutUint32(v, uint32(dpi*100+0.5))
+			order.PutUint32(v[4:], 100)
+			return v
+		}
+		unit := make([]byte, 2)
+		order.PutUint16(unit, 2) // Inches.
+		dir.entries = append(dir.entries,
+			tiffEntry{tag: tagXResolution, typ: 5, count: 1},
+			tiffEntry{tag: tagYResolution, typ: 5, count: 1},
+			tiffEntry{tag: tagResolutionUnit, typ: 3, count: 1})
+		dir.values = append(dir.values, rational(m.dpiX), rational(m.dpiY), unit)
+	}
+	if len(m.icc) > 0 {
+		dir.entries = append(dir.entries, tiffEntry{tag: tagICCProfile, typ: 7, count: uint32(len(m.icc))})
+		dir.values = append(dir.values, m.icc)
+	}
+
+	buf := append([]byte(nil), data...)
+	// Directories start on a word boundary.
+	if len(buf)%2 == 1 {
+		buf = append(buf, 0)
+	}
+	buf, start := appendPhotoDirs(buf, order, dir, subs)
+	order.PutUint32(buf[start+2+12*len(dir.entries):], next)
+	order.PutUint32(buf[4:], uint32(start))
+	return buf, nil
+}
+
+// embedBMPMetadata sets the resolution of an encoded BMP. The format has
+// no room for the rest of m.
+func embedBMPMetadata(data []byte, m metadata) ([]byte, error) {
+	// The pixels per meter follow the 14 byte file header and the first
+	// 24 bytes of the info header.
+	if len(data) < 46 || data[0] != 'B' || data[1] != 'M' {
+		return nil, fmt.Errorf("not a BMP stream")
+	}
+	if m.dpiX > 0 && m.dpiY > 0 {
+		data = append([]byte(nil), data...)
+		binary.LittleEndian.PutUint32(data[38:], uint32(m.dpiX/0.0254+0.5))
+		binary.LittleEndian.PutUint32(data[42:], uint32(m.dpiY/0.0254+0.5))
+	}
+	return data, nil
+}
+
+// keptMetadata applies a --strip-metadata mode to m, the metadata of the
+// input, and returns what goes to the output: m itself, or nil for nothing.
+func keptMetadata(m *metadata, strip string) *metadata {
+	switch strip {
+	case "":
+		m.exif = cleanEXIF(m.exif, false)
+	case "gps":
+		m.exif = cleanEXIF(m.exif, true)
+	case "all":
+		return nil
+	default:
+		panic("unknown -strip-metadata mode " + strip)
+	}
+	return m
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+// tiffFixture builds the first directory of a TIFF file with a
+// resolution, an ICC profile and the descriptive tags of exifFixture.
+func tiffFixture(order binary.ByteOrder, unit uint16) []byte {
+	rational := func(num, den uint32) []byte {
+		return append(long(order, num), long(order, den)...)
+	}
+	buf := tiffHeader(order)
+	buf, pos := appendIFD(buf, order, []tiffEntry{
+		{tag: 0x0100, typ: 3, count: 1}, // ImageWidth, dropped.
+		{tag: 0x010f, typ: 2, count: uint32(len(testMake))},
+		{tag: tagOrientation, typ: 3, count: 1},
+		{tag: tagXResolution, typ: 5, count: 1},
+		{tag: tagYResolution, typ: 5, count: 1},
+		{tag: tagResolutionUnit, typ: 3, count: 1},
+		{tag: tagICCProfile, typ: 7, count: 6},
+		{tag: tagEXIFIFD, typ: 4, count: 1},
+	}, [][]byte{
+		short(order, 640),
+		testMake,
+		short(order, 6),
+		rational(600, 2),
+		rational(150, 1),
+		short(order, unit),
+		[]byte("iccraw"),
+		make([]byte, 4),
+	})
+	order.PutUint32(buf[pos[tagEXIFIFD]:], uint32(len(buf)))
+	buf, _ = appendIFD(buf, order, []tiffEntry{
+		{tag: 0x9003, typ: 2, count: 20}, // DateTimeOriginal
+		{tag: tagInteropIFD, typ: 4, count: 1},
+	}, [][]byte{[]byte("2019:03:12 13:36:53\x00"), long(order, 9999)})
+	return buf
+}
+
+func TestReadTIFFMetadata(t *testing.T) {
+	tests := []struct {
+		name       string
+		order      binary.ByteOrder
+		unit       uint16
+		dpiX, dpiY float64
+	}{
+		{"inch", binary.LittleEndian, 2, 300, 150},
+		{"centimeter", binary.BigEndian, 3, 762, 381},
+		{"no unit", binary.LittleEndian, 1, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := readMetadata(tiffFixture(tt.order, tt.unit))
+			if m.dpiX != tt.dpiX || m.dpiY != tt.dpiY {
+				t.Errorf("dpi = %g×%g, want %g×%g", m.dpiX, m.dpiY, tt.dpiX, tt.dpiY)
+			}
+			if string(m.icc) != "iccraw" {
+				t.Errorf("icc = %q, want %q", m.icc, "iccraw")
+			}
+			if !isTIFF(m.exif) || tiffByteOrder(m.exif) != tt.order {
+				t.Fatalf("exif is not a %v TIFF structure: %q", tt.order, m.exif)
+			}
+			if got := exifOrientation(m.exif); got != 6 {
+				t.Errorf("orientation = %d, want 6", got)
+			}
+			if hasTag(m.exif, 0x0100) {
+				t.Error("image structure tag was copied")
+			}
+			if !bytes.Contains(m.exif, testMake) || !bytes.Contains(m.exif, []byte("2019:03:12 13:36:53")) {
+				t.Error("descriptive tags were lost")
+			}
+
+			var sub []tiffEntry
+			entries, _ := tiffIFD(m.exif, tiffFirstIFD(m.exif))
+			for _, e := range entries {
+				if e.tag == tagEXIFIFD {
+					sub, _ = tiffIFD(m.exif, tt.order.Uint32(e.value))
+				}
+			}
+			if len(sub) != 1 || sub[0].tag != 0x9003 {
+				t.Errorf("EXIF directory = %v, want DateTimeOriginal only", sub)
+			}
+		})
+	}
+}
+
+func TestDecodeImageSwapsDPI(t *testing.T) {
+	// A 2×1 little endian RGB TIFF, orientation 6, 300×150 dpi.
+	order := binary.LittleEndian
+	buf := tiffHeader(order)
+	buf, pos := appendIFD(buf, order, []tiffEntry{
+		{tag: 0x0100, typ: 3, count: 1},
+		{tag: 0x0101, typ: 3, count: 1},
+		{tag: 0x0102, typ: 3, count: 3},
+		{tag: 0x0103, typ: 3, count: 1},
+		{tag: 0x0106, typ: 3, count: 1},
+		{tag: tagStripOffsets, typ: 4, count: 1},
+		{tag: tagOrientation, typ: 3, count: 1},
+		{tag: 0x0115, typ: 3, count: 1},
+		{tag: 0x0116, typ: 3, count: 1},
+		{tag: 0x0117, typ: 4, count: 1},
+		{tag: tagXResolution, typ: 5, count: 1},
+		{tag: tagYResolution, typ: 5, count: 1},
+		{tag: tagResolutionUnit, typ: 3, count: 1},
+	}, [][]byte{
+		short(order, 2),
+		short(order, 1),
+		{8, 0, 8, 0, 8, 0},
+		short(order, 1),
+		short(order, 2),
+		make([]byte, 4),
+		short(order, 6),
+		short(order, 3),
+		short(order, 1),
+		long(order, 6),
+		append(long(order, 300), long(order, 1)...),
+		append(long(order, 150), long(order, 1)...),
+		short(order, 2),
+	})
+	order.PutUint32(buf[pos[tagStripOffsets]:], uint32(len(buf)))
+	buf = append(buf, 255, 0, 0, 0, 0, 255)
+
+	img, _, m, err := decodeImage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 1 || b.Dy() != 2 {
+		t.Errorf("upright size = %v, want 1×2", b.Size())
+	}
+	if m.dpiX != 150 || m.dpiY != 300 {
+		t.Errorf("dpi = %g×%g, want 150×300", m.dpiX, m.dpiY)
+	}
+}
+
+func TestEmbedTIFFMetadata(t *testing.T) {
+	pages := []image.Image{
+		image.NewNRGBA(image.Rect(0, 0, 4, 3)),
+		image.NewNRGBA(image.Rect(0, 0, 2, 5)),
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		doc, err := encodeTIFFPages(pages)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := metadata{exif: exifFixture(order, 1), icc: []byte("iccraw"), dpiX: 300, dpiY: 150}
+		out, err := embedTIFFMetadata(doc, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := readMetadata(out)
+		if m.dpiX != 300 || m.dpiY != 150 {
+			t.Errorf("%v: dpi = %g×%g, want 300×150", order, m.dpiX, m.dpiY)
+		}
+		if string(m.icc) != "iccraw" {
+			t.Errorf("%v: icc = %q, want %q", order, m.icc, "iccraw")
+		}
+		if !bytes.Contains(m.exif, testMake) || exifOrientation(m.exif) != 1 {
+			t.Errorf("%v: make or orientation lost", order)
+		}
+		// The GPS directory is converted to the byte order of the file.
+		var gps []tiffEntry
+		entries, _ := tiffIFD(out, tiffFirstIFD(out))
+		for _, e := range entries {
+			if e.tag == tagGPSIFD {
+				gps, _ = tiffIFD(out, binary.LittleEndian.Uint32(e.value))
+			}
+		}
+		if len(gps) != 2 || gps[1].tag != 2 {
+			t.Fatalf("%v: GPS directory = %v", order, gps)
+		}
+		lat := entryData(out, gps[1])
+		for i := 0; i < len(testLatitude); i += 4 {
+			if got, want := binary.LittleEndian.Uint32(lat[i:]), order.Uint32(testLatitude[i:]); got != want {
+				t.Errorf("%v: latitude word %d = %d, want %d", order, i/4, got, want)
+			}
+		}
+
+		got, _, err := decodeTIFFPages(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 || got[0].Bounds() != pages[0].Bounds() || got[1].Bounds() != pages[1].Bounds() {
+			t.Errorf("%v: pages changed", order)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+const mjpegBoundary = "chrisifyframe"
+
+// detectFunc finds the faces in an image.
+type detectFunc func(img image.Image) ([]*pb.FaceAnnotation, error)
+
+// readMJPEG reads a multipart/x-mixed-replace stream from r and sends the
+// body of every part, a JPEG frame, to frames until the stream ends.
+// frames should have a buffer of one: a frame the receiver has not picked
+// up yet is replaced by the next one, so a slow receiver always gets the
+// latest frame instead of falling further and further behind.
+func readMJPEG(r io.Reader, contentType string, frames chan []byte) error {
+	defer close(frames)
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return fmt.Errorf("not a multipart stream: %s", contentType)
+	}
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		frame, err := ioutil.ReadAll(part)
+		if err != nil {
+			return err
+		}
+		select {
+		case frames <- frame:
+		default:
+			// Drop the stale frame. This is the only sender, so there is
+			// room afterwards.
+			select {
+			case <-frames:
+			default:
+			}
+			frames <- frame
+		}
+	}
+}
+
+// mjpegBroadcaster serves the latest frame to any number of clients as an
+// MJPEG stream.
+type mjpegBroadcaster struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	frame []byte
+	seq   int
+	done  bool
+}
+
+func newMJPEGBroadcaster() *mjpegBroadcaster {
+	b := &mjpegBroadcaster{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// publish replaces the current frame and wakes up the clients.
+func (b *mjpegBroadcaster) publish(frame []byte) {
+	b.mu.Lock()
+	b.frame = frame
+	b.seq++
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// close ends the stream for all clients.
+func (b *mjpegBroadcaster) close() {
+	b.mu.Lock()
+	b.done = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// next waits for a frame newer than seq. It gives up when the stream is
+// closed or ctx is done.
+func (b *mjpegBroadcaster) next(ctx context.Context, seq int) ([]byte, int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.seq == seq && !b.done && ctx.Err() == nil {
+		b.cond.Wait()
+	}
+	return b.frame, b.seq, !b.done && ctx.Err() == nil
+}
+
+func (b *mjpegBroadcaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	w.Header().Set("Cache-Control", "no-cache")
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(mjpegBoundary)
+	flusher, _ := w.(http.Flusher)
+	// Start the stream right away, before the first frame is ready.
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	// Wake up on client disconnect so the handler does not leak. Taking
+	// the lock first makes sure next is either waiting or yet to check
+	// the context.
+	ctx := r.Context()
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		b.mu.Unlock()
+		b.cond.Broadcast()
+	}()
+
+	seq := 0
+	for {
+		frame, s, ok := b.next(ctx, seq)
+		if !ok {
+			return
+		}
+		seq = s
+		part, err := mw.CreatePart(map[string][]string{
+			"Content-Type":   {"image/jpeg"},
+			"Content-Length": {fmt.Sprint(len(frame))},
+		})
+		if err != nil {
+			return
+		}
+		if _, err := part.Write(frame); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// chrisifyMJPEG replaces faces in every frame read from frames and
+// publishes the results. Detection runs in the background at most once
+// per interval on the latest frame; frames in between reuse the tracked
+// faces. Frames that arrive while one is being rendered are dropped but
+// for the latest, see readMJPEG.
+func chrisifyMJPEG(frames <-chan []byte, out *mjpegBroadcaster, detect detectFunc, library FaceList, opts renderOptions, interval time.Duration, smoothing float64, quality int) {
+	type result struct {
+		faces []*pb.FaceAnnotation
+		err   error
+	}
+	tr := newTracker(library, smoothing)
+	results := make(chan result, 1)
+	busy := false
+	var last time.Time
+
+	for data := range frames {
+		tr.tick()
+		select {
+		case res := <-results:
+			busy = false
+			if res.err != nil {
+				log.Printf("face detection failed: %s", res.err)
+			} else {
+				tr.update(suppressDuplicates(res.faces, opts.nms))
+			}
+		default:
+		}
+
+		frame, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			log.Printf("skipping bad frame: %s", err)
+			continue
+		}
+		if !busy && time.Since(last) >= interval {
+			busy, last = true, time.Now()
+			go func(img image.Image) {
+				faces, err := detect(img)
+				results <- result{faces, err}
+			}(frame)
+		}
+
+		faces, assign := tr.faces()
+		if len(faces) == 0 {
+			out.publish(data)
+			continue
+		}
+		var buf bytes.Buffer
+		rendered := render(frame, faces, library, assign, opts)
+		if err := jpeg.Encode(&buf, rendered, &jpeg.Options{Quality: quality}); err != nil {
+			log.Printf("encoding frame: %s", err)
+			continue
+		}
+		out.publish(buf.Bytes())
+	}
+	out.close()
+}
+
+// serveMJPEG reads the MJPEG stream at url and republishes it chrisified
+// on addr until the source stream ends.
+func serveMJPEG(ctx context.Context, url, addr string, detect detectFunc, library FaceList, opts renderOptions, interval time.Duration, smoothing float64, quality int) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+
+	out := newMJPEGBroadcaster()
+	server := &http.Server{Addr: addr, Handler: out}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("serving %s: %s", addr, err)
+		}
+	}()
+	log.Printf("serving chrisified %s on http://%s/", url, addr)
+
+	frames := make(chan []byte, 1)
+	done := make(chan struct{})
+	go func() {
+		chrisifyMJPEG(frames, out, detect, library, opts, interval, smoothing, quality)
+		close(done)
+	}()
+	err = readMJPEG(resp.Body, resp.Header.Get("Content-Type"), frames)
+	<-done
+	server.Close()
+	return err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// testFrame returns a small JPEG of a single gray level.
+func testFrame(t *testing.T, level uint8) []byte {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = level
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// mjpegStream encodes frames as a multipart/x-mixed-replace body.
+func mjpegStream(frames [][]byte) (string, []byte) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, f := range frames {
+		part, _ := mw.CreatePart(map[string][]string{"Content-Type": {"image/jpeg"}})
+		part.Write(f)
+	}
+	mw.Close()
+	return "multipart/x-mixed-replace; boundary=" + mw.Boundary(), buf.Bytes()
+}
+
+// newCamera starts a stand-in camera serving frames as an MJPEG stream.
+func newCamera(frames [][]byte) *httptest.Server {
+	contentType, body := mjpegStream(frames)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(body)
+	}))
+}
+
+func TestReadMJPEG(t *testing.T) {
+	var sent [][]byte
+	for i := 0; i < 5; i++ {
+		sent = append(sent, []byte(fmt.Sprintf("frame %d", i)))
+	}
+	camera := newCamera(sent)
+	defer camera.Close()
+	resp, err := http.Get(camera.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	frames := make(chan []byte, 1)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- readMJPEG(resp.Body, resp.Header.Get("Content-Type"), frames)
+	}()
+	var got [][]byte
+	for f := range frames {
+		got = append(got, f)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 || !bytes.Equal(got[len(got)-1], sent[len(sent)-1]) {
+		t.Fatalf("got %q, want to end with %q", got, sent[len(sent)-1])
+	}
+	// Frames may be dropped, but never reordered.
+	i := 0
+	for _, f := range got {
+		for i < len(sent) && !bytes.Equal(f, sent[i]) {
+			i++
+		}
+		if i == len(sent) {
+			t.Fatalf("got %q, not in sending order", got)
+		}
+	}
+}
+
+func TestReadMJPEGDropsStaleFrames(t *testing.T) {
+	contentType, body := mjpegStream([][]byte{[]byte("old"), []byte("older"), []byte("latest")})
+	frames := make(chan []byte, 1)
+	// Nobody receives while the stream is read.
+	if err := readMJPEG(bytes.NewReader(body), contentType, frames); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for f := range frames {
+		got = append(got, string(f))
+	}
+	if len(got) != 1 || got[0] != "latest" {
+		t.Errorf("got %q, want only the latest frame", got)
+	}
+}
+
+func TestReadMJPEGNotMultipart(t *testing.T) {
+	frames := make(chan []byte, 1)
+	if err := readMJPEG(strings.NewReader(""), "image/jpeg", frames); err == nil {
+		t.Error("expected an error for a non-multipart stream")
+	}
+	if _, ok := <-frames; ok {
+		t.Error("frames was not closed")
+	}
+}
+
+// readPart reads the next frame the broadcaster sent. A part only ends at
+// the next boundary, so it reads Content-Length bytes instead.
+func readPart(t *testing.T, mr *multipart.Reader) []byte {
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(part.Header.Get("Content-Length"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(part, frame); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestBroadcaster(t *testing.T) {
+	b := newMJPEGBroadcaster()
+	returned := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.ServeHTTP(w, r)
+		returned <- struct{}{}
+	}))
+	defer server.Close()
+
+	connect := func(ctx context.Context) *multipart.Reader {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return multipart.NewReader(resp.Body, mjpegBoundary)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gone := connect(ctx)
+	stays := connect(context.Background())
+
+	b.publish([]byte("one"))
+	for _, mr := range []*multipart.Reader{gone, stays} {
+		if got := string(readPart(t, mr)); got != "one" {
+			t.Errorf("got %q, want %q", got, "one")
+		}
+	}
+
+	// A client that disconnects while waiting for the next frame must not
+	// keep its handler around until one arrives.
+	cancel()
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still running after the client went away")
+	}
+
+	b.publish([]byte("two"))
+	if got := string(readPart(t, stays)); got != "two" {
+		t.Errorf("got %q, want %q", got, "two")
+	}
+
+	b.close()
+	if _, err := stays.NextPart(); err == nil {
+		t.Error("stream continued after close")
+	}
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still running after close")
+	}
+}
+
+func TestChrisifyMJPEG(t *testing.T) {
+	camera := newCamera([][]byte{testFrame(t, 50), testFrame(t, 100), testFrame(t, 150)})
+	defer camera.Close()
+	resp, err := http.Get(camera.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	out := newMJPEGBroadcaster()
+	frames := make(chan []byte, 1)
+	done := make(chan struct{})
+	noFaces := func(image.Image) ([]*pb.FaceAnnotation, error) { return nil, nil }
+	face := &Face{Image: image.NewUniform(color.White), Name: "white"}
+	go func() {
+		chrisifyMJPEG(frames, out, noFaces, FaceList{face}, renderOptions{headScale: 1}, 0, 1, 90)
+		close(done)
+	}()
+	if err := readMJPEG(resp.Body, resp.Header.Get("Content-Type"), frames); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	// Without faces the last camera frame is passed through untouched.
+	if !out.done || !bytes.Equal(out.frame, testFrame(t, 150)) {
+		t.Errorf("last published frame is not the camera's last frame")
+	}
+}
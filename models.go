@@ -1,41 +1,47 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"image"
 	"io/ioutil"
 	"math/rand"
-	"os"
 	"path"
 	"path/filepath"
-	"time"
 
 	"github.com/disintegration/imaging"
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
 type Face struct {
 	image.Image
+	// Name is the file the face was loaded from.
+	Name string
+	// flipped is set for mirrored copies of a library face.
+	flipped bool
 }
 
-func (f *Face) LoadFile(file string) error {
-	reader, err := os.Open(file)
+// LoadFile decodes file into the face. With colorManage set, faces with an
+// embedded RGB color profile are converted to sRGB, the working space.
+func (f *Face) LoadFile(file string, colorManage bool) error {
+	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		return err
 	}
-	f.Image, _, err = image.Decode(reader)
+	f.Image, _, err = image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
+	if icc := readMetadata(data).icc; colorManage && icc != nil {
+		if profile, err := parseICC(icc); err == nil {
+			f.Image = convertProfile(f.Image, profile, srgbProfile())
+		}
+	}
 	return nil
 }
 
-func NewFace(file string) (*Face, error) {
-	face := &Face{}
-	if err := face.LoadFile(file); err != nil {
+func NewFace(file string, colorManage bool) (*Face, error) {
+	face := &Face{Name: filepath.Base(file)}
+	if err := face.LoadFile(file, colorManage); err != nil {
 		return face, err
 	}
 	return face, nil
@@ -52,7 +58,17 @@ func (fl FaceList) Random() image.Image {
 	return face.Image
 }
 
-func (fl *FaceList) Load(dir string) error {
+// index returns the position of the face loaded from name, or -1.
+func (fl FaceList) index(name string) int {
+	for i, f := range fl {
+		if f.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (fl *FaceList) Load(dir string, colorManage bool) error {
 	if dir == "" {
 		return fmt.Errorf("No face directory specified")
 	}
@@ -62,7 +78,7 @@ func (fl *FaceList) Load(dir string) error {
 	}
 	for _, file := range files {
 		if filepath.Ext(file.Name()) == ".png" {
-			f, err := NewFace(path.Join(dir, file.Name()))
+			f, err := NewFace(path.Join(dir, file.Name()), colorManage)
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// mosaicGrid is how many cells per side a tile is divided into when
+// comparing its structure.
+const mosaicGrid = 4
+
+// mosaicCacheDir is the directory under the user's cache directory the
+// tile statistics are kept in between runs, one file per faces directory.
+const mosaicCacheDir = "chrisify"
+
+// tileStats describes a library face as a mosaic tile: the Lab color of
+// every grid cell, row by row, and how much of the cell the face covers.
+type tileStats struct {
+	Lab   [mosaicGrid * mosaicGrid][3]float64 `json:"lab"`
+	Cover [mosaicGrid * mosaicGrid]float64    `json:"cover"`
+}
+
+// cachedStats are the statistics of a face file, valid while its size and
+// modification time stay the same.
+type cachedStats struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Stats   tileStats `json:"stats"`
+}
+
+func labOf(c color.NRGBA) [3]float64 {
+	l, a, b := colorful.Color{R: float64(c.R) / 255, G: float64(c.G) / 255, B: float64(c.B) / 255}.Lab()
+	return [3]float64{l, a, b}
+}
+
+// faceStats computes the tile statistics of a face cropped to a square.
+func faceStats(face image.Image) tileStats {
+	const cell = 16
+	square := imaging.Fill(face, cell*mosaicGrid, cell*mosaicGrid, imaging.Center, imaging.Lanczos)
+	var s tileStats
+	for k := range s.Lab {
+		x0, y0 := k%mosaicGrid*cell, k/mosaicGrid*cell
+		var sum [3]float64
+		var weight float64
+		for y := y0; y < y0+cell; y++ {
+			for x := x0; x < x0+cell; x++ {
+				c := square.NRGBAAt(x, y)
+				if c.A == 0 {
+					continue
+				}
+				w := float64(c.A) / 255
+				lab := labOf(c)
+				for i := range sum {
+					sum[i] += lab[i] * w
+				}
+				weight += w
+			}
+		}
+		if weight > 0 {
+			for i := range sum {
+				s.Lab[k][i] = sum[i] / weight
+			}
+		}
+		s.Cover[k] = weight / (cell * cell)
+	}
+	return s
+}
+
+// libraryStats returns the tile statistics of every library face loaded
+// from dir. Statistics are computed once per face file and cached in the
+// user's cache directory; without one they only last for this run.
+func libraryStats(dir string, library FaceList) []tileStats {
+	path := ""
+	if base, err := os.UserCacheDir(); err == nil {
+		sum := sha256.Sum256([]byte(dir))
+		path = filepath.Join(base, mosaicCacheDir, "mosaic-"+hex.EncodeToString(sum[:8])+".json")
+	}
+	cache := map[string]cachedStats{}
+	if path != "" {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			json.Unmarshal(data, &cache)
+		}
+	}
+
+	stats := make([]tileStats, len(library))
+	dirty := false
+	for i, face := range library {
+		fi, err := os.Stat(filepath.Join(dir, face.Name))
+		if err != nil {
+			stats[i] = faceStats(face)
+			continue
+		}
+		c, ok := cache[face.Name]
+		if !ok || c.Size != fi.Size() || !c.ModTime.Equal(fi.ModTime()) {
+			c = cachedStats{Size: fi.Size(), ModTime: fi.ModTime(), Stats: faceStats(face)}
+			cache[face.Name] = c
+			dirty = true
+		}
+		stats[i] = c.Stats
+	}
+
+	if dirty && path != "" {
+		data, err := json.Marshal(cache)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(path, data, 0644)
+		}
+		if err != nil {
+			log.Printf("not caching mosaic statistics: %s", err)
+		}
+	}
+	return stats
+}
+
+// cellStats returns the Lab color of every grid cell of every tile of
+// img, split into cols by rows tiles.
+func cellStats(img image.Image, cols, rows int) [][mosaicGrid * mosaicGrid][3]float64 {
+	small := imaging.Resize(img, cols*mosaicGrid, rows*mosaicGrid, imaging.Box)
+	cells := make([][mosaicGrid * mosaicGrid][3]float64, cols*rows)
+	for i := range cells {
+		x0, y0 := i%cols*mosaicGrid, i/cols*mosaicGrid
+		for k := range cells[i] {
+			cells[i][k] = labOf(small.NRGBAAt(x0+k%mosaicGrid, y0+k/mosaicGrid))
+		}
+	}
+	return cells
+}
+
+// meanLab is the average color of a tile.
+func meanLab(cell [mosaicGrid * mosaicGrid][3]float64) [3]float64 {
+	var m [3]float64
+	for _, c := range cell {
+		for i := range m {
+			m[i] += c[i] / float64(len(cell))
+		}
+	}
+	return m
+}
+
+// mosaicCost compares a face with a tile of the photo, cell by cell, so
+// that both the average color and where the tile is light or dark count.
+// Where the face does not cover a cell the tile's average color shows.
+func mosaicCost(face tileStats, cell [mosaicGrid * mosaicGrid][3]float64, mean [3]float64) float64 {
+	var d float64
+	for k, c := range cell {
+		cover := face.Cover[k]
+		for i := range c {
+			v := face.Lab[k][i]*cover + mean[i]*(1-cover) - c[i]
+			d += v * v
+		}
+	}
+	return d
+}
+
+// mosaic rebuilds img out of library faces, one per size by size tile.
+// No face is used more than maxRepeats times unless the library runs out,
+// 0 allows any number, and neighboring tiles get different faces where
+// possible. tint transfers the colors of every tile of the photo onto its
+// face.
+func mosaic(img image.Image, library FaceList, stats []tileStats, size, maxRepeats int, tint bool) image.Image {
+	if size < 1 {
+		size = 1
+	}
+	b := img.Bounds()
+	cols := (b.Dx() + size - 1) / size
+	rows := (b.Dy() + size - 1) / size
+	cells := cellStats(img, cols, rows)
+
+	// Tiles are chosen in random order so the repeat limit does not favor
+	// the top of the image.
+	choice := make([]int, len(cells))
+	for i := range choice {
+		choice[i] = -1
+	}
+	uses := make([]int, len(library))
+	for _, i := range rand.Perm(len(cells)) {
+		mean := meanLab(cells[i])
+		neighbor := func(j int) bool {
+			x, y := i%cols, i/cols
+			for _, n := range [][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+				if n[0] >= 0 && n[0] < cols && n[1] >= 0 && n[1] < rows && choice[n[1]*cols+n[0]] == j {
+					return true
+				}
+			}
+			return false
+		}
+		pick := func(limited bool) int {
+			best, bestCost := -1, math.Inf(1)
+			for j := range library {
+				if limited && ((maxRepeats > 0 && uses[j] >= maxRepeats) || (len(library) > 4 && neighbor(j))) {
+					continue
+				}
+				if c := mosaicCost(stats[j], cells[i], mean); c < bestCost {
+					best, bestCost = j, c
+				}
+			}
+			return best
+		}
+		j := pick(true)
+		if j < 0 {
+			j = pick(false)
+		}
+		choice[i] = j
+		uses[j]++
+	}
+
+	tiles := make([]image.Image, len(library))
+	source := canvasFromImage(img)
+	out := image.NewRGBA(b)
+	for i, j := range choice {
+		if tiles[j] == nil {
+			tiles[j] = imaging.Fill(library[j], size, size, imaging.Center, imaging.Lanczos)
+		}
+		r := image.Rect(0, 0, size, size).Add(b.Min).Add(image.Pt(i%cols*size, i/cols*size))
+		mean := meanLab(cells[i])
+		bg := colorful.Lab(mean[0], mean[1], mean[2]).Clamped()
+		draw.Draw(out, r, image.NewUniform(bg), image.Point{}, draw.Src)
+
+		tile := tiles[j]
+		if tint {
+			tile = transferColor(source.SubImage(r.Intersect(b)), tile, false)
+		}
+		draw.Draw(out, r, tile, tile.Bounds().Min, draw.Over)
+	}
+	return out
+}
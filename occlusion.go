@@ -0,0 +1,182 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"cloud.google.com/go/vision/apiv1"
+	"github.com/disintegration/imaging"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// skinModel is the mean and spread of skin color in YCbCr chroma, sampled
+// from the cheeks and nose of a detected face.
+type skinModel struct {
+	cb, cr     float64
+	sdCb, sdCr float64
+}
+
+// isSkin reports whether c is close enough to the sampled skin chroma.
+func (m skinModel) isSkin(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	_, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+	dcb := (float64(cb) - m.cb) / math.Max(m.sdCb, 4)
+	dcr := (float64(cr) - m.cr) / math.Max(m.sdCr, 4)
+	return dcb*dcb+dcr*dcr < 9
+}
+
+// sampleSkin builds a skin model from a small box around the nose of the
+// face, falling back to the middle of the detected box.
+func sampleSkin(img image.Image, rect image.Rectangle, lm *vision.FaceLandmarks) skinModel {
+	center := image.Pt(rect.Min.X+rect.Dx()/2, rect.Min.Y+rect.Dy()*3/5)
+	if lm != nil && lm.Nose.Tip != nil {
+		center = image.Pt(int(lm.Nose.Tip.X), int(lm.Nose.Tip.Y))
+	}
+	d := rect.Dx() / 8
+	box := image.Rect(center.X-d, center.Y-d/2, center.X+d, center.Y+d).Intersect(img.Bounds())
+
+	var sumCb, sumCr, sqCb, sqCr float64
+	n := 0
+	for y := box.Min.Y; y < box.Max.Y; y++ {
+		for x := box.Min.X; x < box.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			_, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			sumCb += float64(cb)
+			sumCr += float64(cr)
+			sqCb += float64(cb) * float64(cb)
+			sqCr += float64(cr) * float64(cr)
+			n++
+		}
+	}
+	if n == 0 {
+		// Typical skin chroma when nothing can be sampled.
+		return skinModel{cb: 110, cr: 150, sdCb: 10, sdCr: 10}
+	}
+	m := skinModel{cb: sumCb / float64(n), cr: sumCr / float64(n)}
+	m.sdCb = math.Sqrt(math.Max(0, sqCb/float64(n)-m.cb*m.cb))
+	m.sdCr = math.Sqrt(math.Max(0, sqCr/float64(n)-m.cr*m.cr))
+	return m
+}
+
+// gradient returns the Sobel gradient magnitude of the luma of img at (x, y).
+func gradient(img image.Image, x, y int) float64 {
+	l := func(x, y int) float64 {
+		c, _, _, _ := color.GrayModel.Convert(img.At(x, y)).RGBA()
+		return float64(c >> 8)
+	}
+	gx := l(x+1, y-1) + 2*l(x+1, y) + l(x+1, y+1) - l(x-1, y-1) - 2*l(x-1, y) - l(x-1, y+1)
+	gy := l(x-1, y+1) + 2*l(x, y+1) + l(x+1, y+1) - l(x-1, y-1) - 2*l(x, y-1) - l(x+1, y-1)
+	return math.Hypot(gx, gy)
+}
+
+// occlusionMask segments the parts of p.rect in img that cover the face and
+// should stay on top of the pasted replacement: a hat above the brows when
+// Vision reports headwear, and dark, edgy glasses frames around the eyes.
+// It returns nil when nothing is found.
+func occlusionMask(img image.Image, p placement) *image.Alpha {
+	r := p.rect.Intersect(img.Bounds()).Inset(1)
+	if r.Empty() || p.annotation == nil {
+		return nil
+	}
+	lm := vision.FaceFromLandmarks(p.annotation.Landmarks)
+	skin := sampleSkin(img, p.sample, lm)
+	mask := image.NewAlpha(p.rect)
+	found := false
+
+	if likely(p.annotation.HeadwearLikelihood) {
+		// Everything above the brows that is not skin belongs to the hat.
+		brow := p.sample.Min.Y + p.sample.Dy()/4
+		if y, ok := landmarkY(lm.Eyebrows.Left.Top, lm.Eyebrows.Right.Top); ok {
+			brow = y - p.sample.Dy()/20
+		}
+		for y := r.Min.Y; y < brow && y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if !skin.isSkin(img.At(x, y)) {
+					mask.SetAlpha(x, y, color.Alpha{0xff})
+					found = true
+				}
+			}
+		}
+	}
+
+	if eyes, ok := landmarkY(lm.Eyes.Left.Center, lm.Eyes.Right.Center); ok {
+		// Glasses are a band of dark, high-contrast non-skin pixels
+		// around the eyes. Only keep it if enough of the band looks
+		// like a frame, otherwise dark eyes and brows would survive.
+		band := image.Rect(r.Min.X, eyes-p.sample.Dy()/8, r.Max.X, eyes+p.sample.Dy()/10).Intersect(r)
+		frame := image.NewAlpha(band)
+		hits := 0
+		for y := band.Min.Y; y < band.Max.Y; y++ {
+			for x := band.Min.X; x < band.Max.X; x++ {
+				c := img.At(x, y)
+				g, _, _, _ := color.GrayModel.Convert(c).RGBA()
+				if g>>8 < 70 && !skin.isSkin(c) && gradient(img, x, y) > 120 {
+					frame.SetAlpha(x, y, color.Alpha{0xff})
+					hits++
+				}
+			}
+		}
+		if hits > band.Dx()*band.Dy()/25 {
+			draw.Draw(mask, band, frame, band.Min, draw.Over)
+			found = true
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	return softenMask(mask)
+}
+
+// landmarkY returns the mean Y of the given landmarks if all are present.
+func landmarkY(ps ...*pb.Position) (int, bool) {
+	var sum float32
+	for _, p := range ps {
+		if p == nil {
+			return 0, false
+		}
+		sum += p.Y
+	}
+	return int(sum / float32(len(ps))), true
+}
+
+// softenMask closes small holes in a mask and feathers its edges.
+func softenMask(mask *image.Alpha) *image.Alpha {
+	blurred := imaging.Blur(mask, 1.5)
+	out := image.NewAlpha(mask.Rect)
+	for y := 0; y < mask.Rect.Dy(); y++ {
+		for x := 0; x < mask.Rect.Dx(); x++ {
+			// Blur gives fractional coverage, doubling it grows the mask a
+			// little so thin frames stay continuous.
+			a := int(blurred.NRGBAAt(x, y).A) * 2
+			if a > 0xff {
+				a = 0xff
+			}
+			out.SetAlpha(mask.Rect.Min.X+x, mask.Rect.Min.Y+y, color.Alpha{uint8(a)})
+		}
+	}
+	return out
+}
+
+// restoreOcclusions draws the occluding parts of the original photo back
+// on top of a pasted face. It returns the mask of the restored pixels, nil
+// if there were none.
+func restoreOcclusions(canvas draw.Image, base image.Image, p placement, linear bool) *image.Alpha {
+	mask := occlusionMask(base, p)
+	if mask == nil {
+		return nil
+	}
+	if p.mask != nil {
+		// Keep to the part of the face that was actually pasted.
+		for y := mask.Rect.Min.Y; y < mask.Rect.Max.Y; y++ {
+			for x := mask.Rect.Min.X; x < mask.Rect.Max.X; x++ {
+				a := uint32(mask.AlphaAt(x, y).A) * uint32(p.mask.AlphaAt(x, y).A) / 0xff
+				mask.SetAlpha(x, y, color.Alpha{uint8(a)})
+			}
+		}
+	}
+	drawOver(canvas, mask.Rect, base, mask.Rect.Min, mask, mask.Rect.Min, linear)
+	return mask
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// oraImage is the stack.xml document of an OpenRaster file.
+type oraImage struct {
+	XMLName xml.Name   `xml:"image"`
+	Version string     `xml:"version,attr"`
+	W       int        `xml:"w,attr"`
+	H       int        `xml:"h,attr"`
+	Layers  []oraLayer `xml:"stack>layer"`
+}
+
+type oraLayer struct {
+	Name       string  `xml:"name,attr"`
+	Src        string  `xml:"src,attr"`
+	X          int     `xml:"x,attr"`
+	Y          int     `xml:"y,attr"`
+	Opacity    float64 `xml:"opacity,attr"`
+	Visibility string  `xml:"visibility,attr"`
+}
+
+// writeORA writes an OpenRaster file with the original photo as the bottom
+// layer and every pasted face as a layer of its own above it. layers are
+// ordered back to front, as returned by renderLayers; merged is the
+// flattened result shown by viewers that do not read layers.
+func writeORA(w io.Writer, original, merged image.Image, layers []layer) error {
+	bounds := original.Bounds()
+	zw := zip.NewWriter(w)
+
+	// The mimetype must come first and be stored uncompressed so the file
+	// type can be sniffed from a fixed offset.
+	mw, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(mw, "image/openraster"); err != nil {
+		return err
+	}
+
+	writePNG := func(name string, img image.Image) error {
+		fw, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		return png.Encode(fw, img)
+	}
+
+	stack := oraImage{Version: "0.0.5", W: bounds.Dx(), H: bounds.Dy()}
+	// The stack lists the topmost layer first.
+	for i := len(layers) - 1; i >= 0; i-- {
+		l := layers[i]
+		name := fmt.Sprintf("Face %d (%s)", l.index+1, l.name)
+		src := fmt.Sprintf("data/face-%d.png", l.index+1)
+		if l.index < 0 {
+			name = fmt.Sprintf("Peeking face (%s)", l.name)
+			src = "data/peeking-face.png"
+		}
+		if err := writePNG(src, l.img); err != nil {
+			return err
+		}
+		stack.Layers = append(stack.Layers, oraLayer{
+			Name:       name,
+			Src:        src,
+			X:          l.img.Rect.Min.X - bounds.Min.X,
+			Y:          l.img.Rect.Min.Y - bounds.Min.Y,
+			Opacity:    1,
+			Visibility: "visible",
+		})
+	}
+	if err := writePNG("data/original.png", original); err != nil {
+		return err
+	}
+	stack.Layers = append(stack.Layers, oraLayer{
+		Name:       "Original",
+		Src:        "data/original.png",
+		Opacity:    1,
+		Visibility: "visible",
+	})
+
+	sw, err := zw.Create("stack.xml")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(sw, xml.Header); err != nil {
+		return err
+	}
+	if err := xml.NewEncoder(sw).Encode(stack); err != nil {
+		return err
+	}
+
+	if err := writePNG("mergedimage.png", merged); err != nil {
+		return err
+	}
+	if err := writePNG("Thumbnails/thumbnail.png", imaging.Fit(merged, 256, 256, imaging.Lanczos)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// orientation is an EXIF orientation, 1 to 8, describing how the stored
+// pixels have to be transformed to display the image upright.
+type orientation int
+
+// swapsAxes reports whether o turns the image on its side.
+func (o orientation) swapsAxes() bool {
+	return o >= 5 && o <= 8
+}
+
+// point maps (x, y) in a stored w×h image to the upright frame.
+func (o orientation) point(x, y, w, h float32) (float32, float32) {
+	switch o {
+	case 2:
+		return w - x, y
+	case 3:
+		return w - x, h - y
+	case 4:
+		return x, h - y
+	case 5:
+		return y, x
+	case 6:
+		return h - y, x
+	case 7:
+		return h - y, w - x
+	case 8:
+		return y, w - x
+	}
+	return x, y
+}
+
+// roll returns the clockwise rotation in degrees that o applies and
+// whether the image is mirrored horizontally before that rotation.
+func (o orientation) roll() (float32, bool) {
+	switch o {
+	case 2:
+		return 0, true
+	case 3:
+		return 180, false
+	case 4:
+		return 180, true
+	case 5:
+		return 270, true
+	case 6:
+		return 90, false
+	case 7:
+		return 90, true
+	case 8:
+		return 270, false
+	}
+	return 0, false
+}
+
+// apply returns img transformed to the upright frame. The pixel type of
+// img is kept where possible so deep images stay deep.
+func (o orientation) apply(img image.Image) image.Image {
+	if o <= 1 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o.swapsAxes() {
+		dw, dh = h, w
+	}
+	var dst draw.Image
+	if isDeep(img) {
+		dst = image.NewNRGBA64(image.Rect(0, 0, dw, dh))
+	} else {
+		dst = image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// Map pixel centers so that flips land on whole pixels.
+			fx, fy := o.point(float32(x)+0.5, float32(y)+0.5, float32(w), float32(h))
+			dst.Set(int(fx), int(fy), img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// faces maps face annotations from the stored w×h frame Vision saw into
+// the upright frame, in place.
+func (o orientation) faces(faces []*pb.FaceAnnotation, w, h int) {
+	if o <= 1 || o > 8 {
+		return
+	}
+	fw, fh := float32(w), float32(h)
+	movePoly := func(poly *pb.BoundingPoly) {
+		if poly == nil {
+			return
+		}
+		for _, v := range poly.Vertices {
+			x, y := o.point(float32(v.X), float32(v.Y), fw, fh)
+			v.X, v.Y = int32(x), int32(y)
+		}
+	}
+	rot, mirrored := o.roll()
+	for _, face := range faces {
+		movePoly(face.BoundingPoly)
+		movePoly(face.FdBoundingPoly)
+		for _, lm := range face.Landmarks {
+			if lm.Position != nil {
+				lm.Position.X, lm.Position.Y = o.point(lm.Position.X, lm.Position.Y, fw, fh)
+			}
+		}
+		if mirrored {
+			face.RollAngle, face.PanAngle = -face.RollAngle, -face.PanAngle
+		}
+		face.RollAngle += rot
+		for face.RollAngle > 180 {
+			face.RollAngle -= 360
+		}
+		for face.RollAngle <= -180 {
+			face.RollAngle += 360
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// encodeOptions selects the output format and its settings. meta, if set,
+// is embedded in formats that support it.
+type encodeOptions struct {
+	format         string
+	jpegQuality    int
+	pngCompression png.CompressionLevel
+	meta           *metadata
+}
+
+// formatFromName infers the output format from a file name's extension.
+func formatFromName(name string) (string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return "jpeg", nil
+	case ".png":
+		return "png", nil
+	case ".gif":
+		return "gif", nil
+	case ".tif", ".tiff":
+		return "tiff", nil
+	case ".bmp":
+		return "bmp", nil
+	case ".ora":
+		return "ora", nil
+	case ".html", ".htm":
+		return "html", nil
+	}
+	return "", fmt.Errorf("unknown output format for %s", name)
+}
+
+// parseFormat normalizes a format name given on the command line.
+func parseFormat(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "jpg", "jpeg":
+		return "jpeg", nil
+	case "png", "gif", "bmp", "ora", "html":
+		return strings.ToLower(name), nil
+	case "tif", "tiff":
+		return "tiff", nil
+	}
+	return "", fmt.Errorf("unknown output format %q", name)
+}
+
+// parsePNGCompression maps a compression level name to png's levels.
+func parsePNGCompression(name string) (png.CompressionLevel, error) {
+	switch strings.ToLower(name) {
+	case "", "default":
+		return png.DefaultCompression, nil
+	case "none":
+		return png.NoCompression, nil
+	case "fast":
+		return png.BestSpeed, nil
+	case "best":
+		return png.BestCompression, nil
+	}
+	return 0, fmt.Errorf("unknown PNG compression level %q", name)
+}
+
+// encodeImage writes img to w in the format selected by opts.
+func encodeImage(w io.Writer, img image.Image, opts encodeOptions) error {
+	if opts.meta == nil {
+		return encodeFormat(w, img, opts)
+	}
+	var buf bytes.Buffer
+	if err := encodeFormat(&buf, img, opts); err != nil {
+		return err
+	}
+	data, err := embedMetadata(buf.Bytes(), opts.format, *opts.meta)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func encodeFormat(w io.Writer, img image.Image, opts encodeOptions) error {
+	switch opts.format {
+	case "", "png":
+		enc := png.Encoder{CompressionLevel: opts.pngCompression}
+		return enc.Encode(w, img)
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: opts.jpegQuality})
+	case "gif":
+		return gif.Encode(w, img, nil)
+	case "tiff":
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
+	case "bmp":
+		return bmp.Encode(w, img)
+	}
+	return fmt.Errorf("unknown output format %q", opts.format)
+}
+
+// writeOutput encodes img to path, or to stdout when path is empty or "-".
+func writeOutput(path string, img image.Image, opts encodeOptions) error {
+	return writeFile(path, func(w io.Writer) error {
+		return encodeImage(w, img, opts)
+	})
+}
+
+// writeAnimation writes g to path, or to stdout when path is empty or "-".
+func writeAnimation(path string, g *gif.GIF) error {
+	return writeFile(path, func(w io.Writer) error {
+		return gif.EncodeAll(w, g)
+	})
+}
+
+// writeFile creates path and writes it with write, or writes to stdout
+// when path is empty or "-".
+func writeFile(path string, write func(io.Writer) error) error {
+	if path == "" || path == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// outputOptions builds the encode options from the output flags.
+func outputOptions(path, format string, quality int, compression string) (encodeOptions, error) {
+	opts := encodeOptions{format: "png", jpegQuality: quality}
+	var err error
+	switch {
+	case format != "":
+		opts.format, err = parseFormat(format)
+	case path != "" && path != "-" && !isDir(path):
+		opts.format, err = formatFromName(path)
+	}
+	if err != nil {
+		return opts, err
+	}
+	if quality < 1 || quality > 100 {
+		return opts, fmt.Errorf("JPEG quality must be between 1 and 100, got %d", quality)
+	}
+	opts.pngCompression, err = parsePNGCompression(compression)
+	return opts, err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"sort"
+
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// polyRect returns the axis aligned rectangle spanned by a bounding poly.
+func polyRect(poly *pb.BoundingPoly) image.Rectangle {
+	if poly == nil || len(poly.Vertices) == 0 {
+		return image.Rectangle{}
+	}
+	v := poly.Vertices[0]
+	r := image.Rect(int(v.X), int(v.Y), int(v.X), int(v.Y))
+	for _, v := range poly.Vertices[1:] {
+		if int(v.X) < r.Min.X {
+			r.Min.X = int(v.X)
+		}
+		if int(v.X) > r.Max.X {
+			r.Max.X = int(v.X)
+		}
+		if int(v.Y) < r.Min.Y {
+			r.Min.Y = int(v.Y)
+		}
+		if int(v.Y) > r.Max.Y {
+			r.Max.Y = int(v.Y)
+		}
+	}
+	return r
+}
+
+// iou returns the intersection over union of two rectangles.
+func iou(a, b image.Rectangle) float64 {
+	inter := a.Intersect(b)
+	if inter.Empty() {
+		return 0
+	}
+	i := float64(inter.Dx() * inter.Dy())
+	u := float64(a.Dx()*a.Dy()+b.Dx()*b.Dy()) - i
+	if u <= 0 {
+		return 0
+	}
+	return i / u
+}
+
+// suppressDuplicates performs non-maximum suppression on the detected faces,
+// dropping any face whose box overlaps a more confident one by more than
+// threshold IoU. The order of the remaining faces is preserved.
+func suppressDuplicates(faces []*pb.FaceAnnotation, threshold float64) []*pb.FaceAnnotation {
+	if threshold <= 0 || len(faces) < 2 {
+		return faces
+	}
+	order := make([]int, len(faces))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return faces[order[i]].DetectionConfidence > faces[order[j]].DetectionConfidence
+	})
+
+	dropped := make([]bool, len(faces))
+	for n, i := range order {
+		if dropped[i] {
+			continue
+		}
+		ri := polyRect(faces[i].BoundingPoly)
+		for _, j := range order[n+1:] {
+			if !dropped[j] && iou(ri, polyRect(faces[j].BoundingPoly)) > threshold {
+				dropped[j] = true
+			}
+		}
+	}
+
+	kept := make([]*pb.FaceAnnotation, 0, len(faces))
+	for i, face := range faces {
+		if !dropped[i] {
+			kept = append(kept, face)
+		}
+	}
+	return kept
+}
+
+// depth estimates how close a face is to the camera relative to the other
+// faces in the image. Larger faces and faces lower in the frame are closer.
+func depth(p placement, bounds image.Rectangle) float64 {
+	if bounds.Empty() {
+		return 0
+	}
+	size := float64(p.sample.Dy()) / float64(bounds.Dy())
+	bottom := float64(p.sample.Max.Y-bounds.Min.Y) / float64(bounds.Dy())
+	return size*2 + bottom
+}
+
+// sortByDepth orders placements from farthest to nearest, which is the
+// order they have to be composited in.
+func sortByDepth(ps []placement, bounds image.Rectangle) {
+	sort.SliceStable(ps, func(i, j int) bool {
+		return depth(ps[i], bounds) < depth(ps[j], bounds)
+	})
+}
+
+// subtractOcclusions gives every placement a mask covering its own rect
+// minus the parts hidden by the detected faces in front of it. ps must be
+// sorted by depth.
+func subtractOcclusions(ps []placement) {
+	for i := range ps {
+		mask := image.NewAlpha(ps[i].rect)
+		for y := mask.Rect.Min.Y; y < mask.Rect.Max.Y; y++ {
+			for x := mask.Rect.Min.X; x < mask.Rect.Max.X; x++ {
+				mask.SetAlpha(x, y, color.Alpha{0xff})
+			}
+		}
+		for _, front := range ps[i+1:] {
+			hidden := front.sample.Intersect(ps[i].rect)
+			for y := hidden.Min.Y; y < hidden.Max.Y; y++ {
+				for x := hidden.Min.X; x < hidden.Max.X; x++ {
+					mask.SetAlpha(x, y, color.Alpha{})
+				}
+			}
+		}
+		ps[i].mask = mask
+	}
+}
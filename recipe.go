@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// recipeKeyword is the keyword of the PNG iTXt chunk holding the recipe.
+const recipeKeyword = "chrisify:recipe"
+
+// recipe records everything needed to render an output again: the input
+// it was made from, the detections, which library face went where and the
+// settings used.
+type recipe struct {
+	// Input is the hex SHA-256 of the input file.
+	Input    string `json:"input"`
+	Detector string `json:"detector"`
+	Seed     int64  `json:"seed"`
+	// Mode is "swap" when the faces were swapped among themselves.
+	Mode     string         `json:"mode,omitempty"`
+	Settings recipeSettings `json:"settings"`
+	Faces    []recipeFace   `json:"faces"`
+}
+
+type recipeSettings struct {
+	HeadScale          float64 `json:"head_scale"`
+	NMS                float64 `json:"nms"`
+	MatchQuality       bool    `json:"match_quality"`
+	AdaptLikelihoods   bool    `json:"adapt_likelihoods"`
+	PreserveOcclusions bool    `json:"preserve_occlusions"`
+	Linear             bool    `json:"linear"`
+	ColorTransfer      bool    `json:"color_transfer"`
+}
+
+// recipeFace is a single replaced face. Box is the detected face and Rect
+// where the library face was pasted, both as x0, y0, x1, y1 in upright
+// image coordinates.
+type recipeFace struct {
+	Library   string             `json:"library"`
+	Flip      bool               `json:"flip"`
+	Box       [4]int             `json:"box"`
+	Rect      [4]int             `json:"rect"`
+	Detection *pb.FaceAnnotation `json:"detection"`
+}
+
+func inputHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func newRecipe(data []byte, seed int64, mode string, faces []*pb.FaceAnnotation, assign []int, library FaceList, opts renderOptions) recipe {
+	c := opts.composite
+	if mode == "replace" {
+		mode = ""
+	}
+	r := recipe{
+		Input:    inputHash(data),
+		Detector: "google-vision/v1",
+		Seed:     seed,
+		Mode:     mode,
+		Settings: recipeSettings{
+			HeadScale:          opts.headScale,
+			NMS:                opts.nms,
+			MatchQuality:       c.matchQuality,
+			AdaptLikelihoods:   c.adaptLikelihoods,
+			PreserveOcclusions: c.preserveOcclusions,
+			Linear:             c.linear,
+			ColorTransfer:      c.colorTransfer,
+		},
+		Faces: make([]recipeFace, len(faces)),
+	}
+	for i, face := range faces {
+		box := polyRect(face.BoundingPoly)
+		rect := headRect(box, opts.headScale)
+		r.Faces[i] = recipeFace{
+			Library:   library[assign[i]].Name,
+			Flip:      library[assign[i]].flipped,
+			Box:       [4]int{box.Min.X, box.Min.Y, box.Max.X, box.Max.Y},
+			Rect:      [4]int{rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y},
+			Detection: face,
+		}
+	}
+	return r
+}
+
+// options returns the recipe's settings, except for those named in keep,
+// the flags given on the command line, which are taken from opts.
+func (s recipeSettings) options(opts renderOptions, keep map[string]bool) renderOptions {
+	set := func(name string, v *bool, recorded bool) {
+		if !keep[name] {
+			*v = recorded
+		}
+	}
+	if !keep["head-scale"] {
+		opts.headScale = s.HeadScale
+	}
+	if !keep["nms"] {
+		opts.nms = s.NMS
+	}
+	c := &opts.composite
+	set("match-quality", &c.matchQuality, s.MatchQuality)
+	set("adapt-likelihoods", &c.adaptLikelihoods, s.AdaptLikelihoods)
+	set("preserve-occlusions", &c.preserveOcclusions, s.PreserveOcclusions)
+	set("linear", &c.linear, s.Linear)
+	set("color-transfer", &c.colorTransfer, s.ColorTransfer)
+	return opts
+}
+
+// detections returns the recorded faces.
+func (r recipe) detections() []*pb.FaceAnnotation {
+	faces := make([]*pb.FaceAnnotation, len(r.Faces))
+	for i, f := range r.Faces {
+		faces[i] = f.Detection
+		if faces[i] == nil {
+			faces[i] = &pb.FaceAnnotation{BoundingPoly: &pb.BoundingPoly{Vertices: boxVertices(f.Box)}}
+		}
+	}
+	return faces
+}
+
+func boxVertices(b [4]int) []*pb.Vertex {
+	return []*pb.Vertex{
+		{X: int32(b[0]), Y: int32(b[1])},
+		{X: int32(b[2]), Y: int32(b[1])},
+		{X: int32(b[2]), Y: int32(b[3])},
+		{X: int32(b[0]), Y: int32(b[3])},
+	}
+}
+
+// assignment looks up the recorded library faces. Flipped faces are added
+// to the returned library as mirrored copies.
+func (r recipe) assignment(library FaceList) (FaceList, []int, error) {
+	lib := append(FaceList(nil), library...)
+	assign := make([]int, len(r.Faces))
+	for i, f := range r.Faces {
+		j := library.index(f.Library)
+		if j < 0 {
+			return nil, nil, fmt.Errorf("no library face named %q", f.Library)
+		}
+		if f.Flip {
+			lib = append(lib, &Face{Image: imaging.FlipH(library[j]), Name: library[j].Name, flipped: true})
+			j = len(lib) - 1
+		}
+		assign[i] = j
+	}
+	return lib, assign, nil
+}
+
+// pngText returns the text of the iTXt chunk with the given keyword, or
+// nil if there is none. Compressed text is not supported.
+func pngText(data []byte, keyword string) []byte {
+	for _, c := range pngChunks(data) {
+		if c.typ != "iTXt" || !bytes.HasPrefix(c.data, []byte(keyword+"\x00")) {
+			continue
+		}
+		// Keyword, compression flag and method, then the language tag and
+		// translated keyword, both null terminated.
+		rest := c.data[len(keyword)+1:]
+		if len(rest) < 2 || rest[0] != 0 {
+			continue
+		}
+		rest = rest[2:]
+		for n := 0; n < 2; n++ {
+			i := bytes.IndexByte(rest, 0)
+			if i < 0 {
+				return nil
+			}
+			rest = rest[i+1:]
+		}
+		return rest
+	}
+	return nil
+}
+
+// pngTextChunk returns an uncompressed iTXt chunk.
+func pngTextChunk(keyword string, text []byte) []byte {
+	payload := append([]byte(keyword), 0, 0, 0, 0, 0)
+	return pngChunkBytes("iTXt", append(payload, text...))
+}
+
+// loadRecipe reads a recipe from a JSON file or from a PNG written with
+// one embedded.
+func loadRecipe(file string) (recipe, error) {
+	var r recipe
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return r, err
+	}
+	if bytes.HasPrefix(data, pngSignature) {
+		data = pngText(data, recipeKeyword)
+		if data == nil {
+			return r, fmt.Errorf("%s has no chrisify recipe", file)
+		}
+	}
+	err = json.Unmarshal(data, &r)
+	return r, err
+}
+
+// overrideAssignment replaces the library faces of the detections named in
+// the comma separated spec. Empty entries keep their face.
+func overrideAssignment(assign []int, spec string, library FaceList) error {
+	if spec == "" {
+		return nil
+	}
+	for i, name := range strings.Split(spec, ",") {
+		if i >= len(assign) {
+			break
+		}
+		if name == "" {
+			continue
+		}
+		j := library.index(name)
+		if j < 0 {
+			return fmt.Errorf("no library face named %q", name)
+		}
+		assign[i] = j
+	}
+	return nil
+}
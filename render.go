@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"math/rand"
+
+	"cloud.google.com/go/vision/apiv1"
+	"golang.org/x/net/context"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// renderOptions controls how a single image is chrisified. nms is the
+// IoU threshold for suppressing duplicate detections, applied by callers
+// before assigning library faces.
+type renderOptions struct {
+	headScale float64
+	nms       float64
+	composite compositeOptions
+}
+
+// detectFaces runs Vision face detection on an encoded image.
+func detectFaces(ctx context.Context, client *vision.ImageAnnotatorClient, data []byte) ([]*pb.FaceAnnotation, error) {
+	img, err := vision.NewImageFromReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return client.DetectFaces(ctx, img, nil, 100)
+}
+
+// detectImage encodes img as PNG and runs face detection on it.
+func detectImage(ctx context.Context, client *vision.ImageAnnotatorClient, img image.Image) ([]*pb.FaceAnnotation, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return detectFaces(ctx, client, buf.Bytes())
+}
+
+// randomAssignment picks a library face for each of n detections, using
+// every library face once before repeating any.
+func randomAssignment(n int, library FaceList) []int {
+	numberList := rand.Perm(len(library))
+	assign := make([]int, n)
+	for i := range assign {
+		assign[i] = numberList[i%len(library)]
+	}
+	return assign
+}
+
+// layer is a pasted face as it ended up on the canvas. index is the face's
+// position in the detection list, -1 for the peeking face, and name the
+// library file it was replaced with. img is in canvas coordinates and its
+// alpha is the coverage of the face.
+type layer struct {
+	index int
+	name  string
+	img   *image.NRGBA
+}
+
+// parseAssignment assigns the comma separated library files in spec to the
+// first detections and random library faces to the rest.
+func parseAssignment(spec string, n int, library FaceList) ([]int, error) {
+	assign := randomAssignment(n, library)
+	if err := overrideAssignment(assign, spec, library); err != nil {
+		return nil, err
+	}
+	return assign, nil
+}
+
+// render pastes library faces over the detected faces of base. faces[i]
+// is replaced by library[assign[i]]. When nothing was detected a face is
+// pasted peeking in from the bottom of the image instead, unless the
+// library is empty, as in swap mode, and base is returned unchanged.
+func render(base image.Image, faces []*pb.FaceAnnotation, library FaceList, assign []int, opts renderOptions) canvasImage {
+	canvas, _ := renderLayers(base, faces, library, assign, opts)
+	return canvas
+}
+
+// renderLayers is render, also returning the pasted faces from back to
+// front.
+func renderLayers(base image.Image, faces []*pb.FaceAnnotation, library FaceList, assign []int, opts renderOptions) (canvasImage, []layer) {
+	bounds := base.Bounds()
+	canvas := canvasFromImage(base)
+	source := canvasFromImage(base)
+
+	placements := make([]placement, 0, len(faces))
+	for i, face := range faces {
+		rect := polyRect(face.BoundingPoly)
+		newFace := library[assign[i]]
+		if newFace == nil {
+			panic("nil face")
+		}
+		placements = append(placements, placement{
+			index:      i,
+			sample:     rect,
+			rect:       headRect(rect, opts.headScale),
+			face:       newFace,
+			annotation: face,
+		})
+	}
+	sortByDepth(placements, bounds)
+	subtractOcclusions(placements)
+
+	var layers []layer
+	for _, p := range placements {
+		if img := pasteFace(canvas, source, p, opts.composite); img != nil {
+			layers = append(layers, layer{p.index, library[assign[p.index]].Name, img})
+		}
+	}
+
+	if len(faces) == 0 && len(library) > 0 {
+		face := resizeImage(
+			library[0],
+			bounds.Dx()/3,
+			0,
+			opts.composite.linear,
+		)
+		faceBounds := face.Bounds()
+		sp := bounds.Min.Add(image.Pt(-bounds.Max.X/2+faceBounds.Max.X/2, -bounds.Max.Y+int(float64(faceBounds.Max.Y)/1.9)))
+		drawOver(
+			canvas,
+			bounds,
+			face,
+			sp,
+			nil,
+			image.Point{},
+			opts.composite.linear,
+		)
+		r := faceBounds.Add(bounds.Min.Sub(sp)).Intersect(bounds)
+		layers = append(layers, layer{-1, library[0].Name, faceLayer(r, face, sp.Sub(bounds.Min), nil, nil)})
+	}
+
+	return canvas, layers
+}
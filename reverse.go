@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"sort"
+
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// manifestFile lists the template photos of a templates directory.
+const manifestFile = "manifest.json"
+
+// sceneTemplate is a library photo the input's faces are pasted onto.
+// Faces are the head boxes in the photo as x0, y0, x1, y1, in upright
+// image coordinates.
+type sceneTemplate struct {
+	File  string   `json:"file"`
+	Faces [][4]int `json:"faces"`
+}
+
+// loadManifest reads the template list of dir.
+func loadManifest(dir string) ([]sceneTemplate, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var templates []sceneTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("%s: %s", manifestFile, err)
+	}
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("%s lists no templates", manifestFile)
+	}
+	return templates, nil
+}
+
+// pickTemplate returns the template named name, or a random one.
+func pickTemplate(templates []sceneTemplate, name string) (sceneTemplate, error) {
+	if name == "" {
+		return templates[rand.Intn(len(templates))], nil
+	}
+	for _, t := range templates {
+		if t.File == name {
+			return t, nil
+		}
+	}
+	return sceneTemplate{}, fmt.Errorf("no template named %q in %s", name, manifestFile)
+}
+
+// annotations turns the template's face boxes into detections.
+func (t sceneTemplate) annotations() []*pb.FaceAnnotation {
+	faces := make([]*pb.FaceAnnotation, len(t.Faces))
+	for i, box := range t.Faces {
+		faces[i] = &pb.FaceAnnotation{BoundingPoly: &pb.BoundingPoly{Vertices: boxVertices(box)}}
+	}
+	return faces
+}
+
+// cross is the z component of the cross product of b-a and c-a.
+func cross(a, b, c [2]float64) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+// convexHull returns the hull of ps in counter-clockwise order.
+func convexHull(ps [][2]float64) [][2]float64 {
+	if len(ps) < 3 {
+		return ps
+	}
+	ps = append([][2]float64(nil), ps...)
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i][0] < ps[j][0] || (ps[i][0] == ps[j][0] && ps[i][1] < ps[j][1])
+	})
+	var hull [][2]float64
+	for pass := 0; pass < 2; pass++ {
+		start := len(hull)
+		for _, p := range ps {
+			for len(hull) >= start+2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+				hull = hull[:len(hull)-1]
+			}
+			hull = append(hull, p)
+		}
+		hull = hull[:len(hull)-1]
+		for i, j := 0, len(ps)-1; i < j; i, j = i+1, j-1 {
+			ps[i], ps[j] = ps[j], ps[i]
+		}
+	}
+	return hull
+}
+
+// faceOutline returns the outline of a face from its landmarks: their hull,
+// raised above the brows to take in the forehead and grown a little to
+// reach the cheeks. It returns nil without enough landmarks.
+func faceOutline(face *pb.FaceAnnotation) [][2]float64 {
+	var ps [][2]float64
+	var brow, chin *pb.Position
+	for _, lm := range face.Landmarks {
+		if lm.Position == nil {
+			continue
+		}
+		ps = append(ps, [2]float64{float64(lm.Position.X), float64(lm.Position.Y)})
+		switch lm.Type {
+		case pb.FaceAnnotation_Landmark_FOREHEAD_GLABELLA:
+			brow = lm.Position
+		case pb.FaceAnnotation_Landmark_CHIN_GNATHION:
+			chin = lm.Position
+		}
+	}
+	if len(ps) < 3 {
+		return nil
+	}
+	if brow != nil && chin != nil {
+		// Lift every point above the glabella by half the face height.
+		up := [2]float64{float64(brow.X-chin.X) * 0.5, float64(brow.Y-chin.Y) * 0.5}
+		n := len(ps)
+		for _, p := range ps[:n] {
+			if p[1] <= float64(brow.Y) {
+				ps = append(ps, [2]float64{p[0] + up[0], p[1] + up[1]})
+			}
+		}
+	}
+	hull := convexHull(ps)
+	var c [2]float64
+	for _, p := range hull {
+		c[0] += p[0] / float64(len(hull))
+		c[1] += p[1] / float64(len(hull))
+	}
+	for i, p := range hull {
+		hull[i] = [2]float64{c[0] + (p[0]-c[0])*1.08, c[1] + (p[1]-c[1])*1.08}
+	}
+	return hull
+}
+
+// insideHull reports whether p lies in a counter-clockwise convex hull.
+func insideHull(hull [][2]float64, p [2]float64) bool {
+	for i := range hull {
+		if cross(hull[i], hull[(i+1)%len(hull)], p) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// cutFace cuts a detected face out of img as a library face: its head box,
+// transparent outside the outline of its landmarks. Faces without
+// landmarks are cut as an ellipse.
+func cutFace(img image.Image, face *pb.FaceAnnotation) *Face {
+	r := polyRect(face.BoundingPoly).Intersect(img.Bounds())
+	mask := image.NewAlpha(r)
+	hull := faceOutline(face)
+	cx, cy := float64(r.Min.X+r.Max.X)/2, float64(r.Min.Y+r.Max.Y)/2
+	rx, ry := float64(r.Dx())/2, float64(r.Dy())/2
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p := [2]float64{float64(x) + 0.5, float64(y) + 0.5}
+			in := false
+			if hull != nil {
+				in = insideHull(hull, p)
+			} else {
+				dx, dy := (p[0]-cx)/rx, (p[1]-cy)/ry
+				in = dx*dx+dy*dy <= 1
+			}
+			if in {
+				mask.SetAlpha(x, y, color.Alpha{0xff})
+			}
+		}
+	}
+	mask = softenMask(mask)
+
+	cut := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.DrawMask(cut, cut.Rect, img, r.Min, mask, r.Min, draw.Src)
+	return &Face{Image: cut}
+}
+
+// reverse pastes the faces detected in the input onto the faces of a
+// template photo, using the same alignment and color transfer as the
+// forward direction.
+func reverse(input image.Image, faces []*pb.FaceAnnotation, template image.Image, t sceneTemplate, opts renderOptions) canvasImage {
+	if len(faces) == 0 {
+		return canvasFromImage(template)
+	}
+	cutouts := cutFaces(input, faces)
+	targets := t.annotations()
+	return render(template, targets, cutouts, randomAssignment(len(targets), cutouts), opts)
+}
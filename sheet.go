@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+var sheetBackground = color.RGBA{0x20, 0x20, 0x20, 0xff}
+
+// scaleFaces returns copies of faces with their coordinates scaled by s.
+func scaleFaces(faces []*pb.FaceAnnotation, s float64) []*pb.FaceAnnotation {
+	scaled := make([]*pb.FaceAnnotation, len(faces))
+	for i, face := range faces {
+		f := proto.Clone(face).(*pb.FaceAnnotation)
+		for _, poly := range []*pb.BoundingPoly{f.BoundingPoly, f.FdBoundingPoly} {
+			if poly == nil {
+				continue
+			}
+			for _, v := range poly.Vertices {
+				v.X = int32(math.Floor(float64(v.X)*s + 0.5))
+				v.Y = int32(math.Floor(float64(v.Y)*s + 0.5))
+			}
+		}
+		for _, lm := range f.Landmarks {
+			if lm.Position != nil {
+				lm.Position.X *= float32(s)
+				lm.Position.Y *= float32(s)
+			}
+		}
+		scaled[i] = f
+	}
+	return scaled
+}
+
+// variation returns the options for the ith tile of a contact sheet. The
+// first tile uses opts as given; the following ones flip linear blending,
+// color transfer and quality matching in turn, so the first eight tiles
+// cover every combination.
+func variation(opts renderOptions, i int) renderOptions {
+	if i&1 != 0 {
+		opts.composite.linear = !opts.composite.linear
+	}
+	if i&2 != 0 {
+		opts.composite.colorTransfer = !opts.composite.colorTransfer
+	}
+	if i&4 != 0 {
+		opts.composite.matchQuality = !opts.composite.matchQuality
+	}
+	return opts
+}
+
+// settingsFlags spells out the flags that render a tile again.
+func settingsFlags(assign []int, library FaceList, opts renderOptions) string {
+	var flags []string
+	if len(assign) > 0 {
+		names := make([]string, len(assign))
+		for i, a := range assign {
+			names[i] = library[a].Name
+		}
+		flags = append(flags, "--assign "+strings.Join(names, ","))
+	}
+	flags = append(flags,
+		fmt.Sprintf("--linear=%t", opts.composite.linear),
+		fmt.Sprintf("--color-transfer=%t", opts.composite.colorTransfer),
+		fmt.Sprintf("--match-quality=%t", opts.composite.matchQuality),
+	)
+	return strings.Join(flags, " ")
+}
+
+// wrapText breaks s into lines of at most width characters, at spaces
+// where possible.
+func wrapText(s string, width int) []string {
+	if width < 1 {
+		width = 1
+	}
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		for len(word) > width {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			lines = append(lines, word[:width])
+			word = word[width:]
+		}
+		switch {
+		case line == "":
+			line = word
+		case len(line)+1+len(word) <= width:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// contactSheet renders n variations of base at tile width and lays them
+// out in a grid. Every tile is labeled with the flags that render it again
+// at full resolution. The first tile uses assign and opts as given, the
+// others random faces and the settings from variation.
+func contactSheet(base image.Image, faces []*pb.FaceAnnotation, library FaceList, assign []int, opts renderOptions, n, width int) image.Image {
+	if n < 1 {
+		n = 1
+	}
+	b := base.Bounds()
+	s := 1.0
+	if width > 0 && width < b.Dx() {
+		s = float64(width) / float64(b.Dx())
+	}
+	tw := int(float64(b.Dx())*s + 0.5)
+	th := int(float64(b.Dy())*s + 0.5)
+	small := resizeImage(base, tw, th, opts.composite.linear)
+	smallFaces := scaleFaces(faces, s)
+
+	const pad, gap = 4, 8
+	char := textSize("M", 1)
+	lineHeight := char.Y + 2
+	tiles := make([]image.Image, n)
+	labels := make([][]string, n)
+	labelHeight := 0
+	for i := range tiles {
+		a := assign
+		if i > 0 {
+			a = randomAssignment(len(faces), library)
+		}
+		o := variation(opts, i)
+		tiles[i] = render(small, smallFaces, library, a, o)
+		labels[i] = wrapText(fmt.Sprintf("#%d %s", i+1, settingsFlags(a, library, o)), (tw-2*pad)/char.X)
+		if h := len(labels[i])*lineHeight + 2*pad; h > labelHeight {
+			labelHeight = h
+		}
+	}
+
+	cols := int(math.Ceil(math.Sqrt(float64(n))))
+	rows := (n + cols - 1) / cols
+	cell := image.Pt(tw+gap, th+labelHeight+gap)
+	r := image.Rect(0, 0, cols*cell.X+gap, rows*cell.Y+gap)
+	var sheet draw.Image = image.NewRGBA(r)
+	if isDeep(base) {
+		sheet = image.NewRGBA64(r)
+	}
+	draw.Draw(sheet, r, image.NewUniform(sheetBackground), image.Point{}, draw.Src)
+	for i, tile := range tiles {
+		at := image.Pt(gap+i%cols*cell.X, gap+i/cols*cell.Y)
+		tb := tile.Bounds()
+		draw.Draw(sheet, tb.Sub(tb.Min).Add(at), tile, tb.Min, draw.Src)
+		y := at.Y + th + pad
+		for _, line := range labels[i] {
+			drawText(sheet, image.Pt(at.X+pad, y), line, 1, debugTextColor)
+			y += lineHeight
+		}
+	}
+	return sheet
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"image"
+
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// cutFaces cuts every detected face out of img as a library, the nth face
+// named face-n.
+func cutFaces(img image.Image, faces []*pb.FaceAnnotation) FaceList {
+	cutouts := make(FaceList, len(faces))
+	for i, face := range faces {
+		cutouts[i] = cutFace(img, face)
+		cutouts[i].Name = fmt.Sprintf("face-%d", i+1)
+	}
+	return cutouts
+}
+
+// swapAssignment rotates n faces: every face gets the next one, the last
+// the first.
+func swapAssignment(n int) []int {
+	assign := make([]int, n)
+	for i := range assign {
+		assign[i] = (i + 1) % n
+	}
+	return assign
+}
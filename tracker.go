@@ -0,0 +1,228 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+)
+
+// track is a face followed across the frames of a sequence.
+type track struct {
+	// face is the library face assigned to the track for its lifetime.
+	face int
+	// box holds the smoothed bounding poly corners: x0, y0, x1, y1.
+	box [4]float64
+	// roll, pan and tilt are the smoothed head angles.
+	roll, pan, tilt float64
+	// landmarks are the smoothed landmark positions by type.
+	landmarks map[pb.FaceAnnotation_Landmark_Type][2]float64
+	// last is the latest detection, rewritten with the smoothed values.
+	last *pb.FaceAnnotation
+	// missed counts the frames since a detection first failed to find
+	// the track, zero while it is found.
+	missed int
+}
+
+// tracker associates face detections across frames so that every person
+// keeps the same library face, and smooths their boxes and angles with an
+// exponential filter to stop the pasted faces from jittering.
+type tracker struct {
+	tracks []*track
+	perm   []int
+	next   int
+	// smoothing is the weight of a new detection against the track's
+	// history, 1 disables smoothing.
+	smoothing float64
+	// maxMissed is how many frames a track survives after a detection
+	// failed to find it.
+	maxMissed int
+}
+
+func newTracker(library FaceList, smoothing float64) *tracker {
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = 1
+	}
+	return &tracker{
+		perm:      rand.Perm(len(library)),
+		smoothing: smoothing,
+		maxMissed: 5,
+	}
+}
+
+func faceBox(face *pb.FaceAnnotation) [4]float64 {
+	r := polyRect(face.BoundingPoly)
+	return [4]float64{float64(r.Min.X), float64(r.Min.Y), float64(r.Max.X), float64(r.Max.Y)}
+}
+
+func boxIoU(a, b [4]float64) float64 {
+	w := math.Min(a[2], b[2]) - math.Max(a[0], b[0])
+	h := math.Min(a[3], b[3]) - math.Max(a[1], b[1])
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+	inter := w * h
+	union := (a[2]-a[0])*(a[3]-a[1]) + (b[2]-b[0])*(b[3]-b[1]) - inter
+	if union <= 0 {
+		return 0
+	}
+	return inter / union
+}
+
+// landmarkDistance returns the mean distance between the landmarks a track
+// and a detection have in common, relative to the track's box diagonal.
+// It returns 1 when there is nothing to compare.
+func (t *track) landmarkDistance(face *pb.FaceAnnotation) float64 {
+	diag := math.Hypot(t.box[2]-t.box[0], t.box[3]-t.box[1])
+	if diag == 0 {
+		return 1
+	}
+	var sum float64
+	n := 0
+	for _, lm := range face.Landmarks {
+		p, ok := t.landmarks[lm.Type]
+		if !ok || lm.Position == nil {
+			continue
+		}
+		sum += math.Hypot(float64(lm.Position.X)-p[0], float64(lm.Position.Y)-p[1])
+		n++
+	}
+	if n == 0 {
+		return 1
+	}
+	return math.Min(sum/float64(n)/diag, 1)
+}
+
+// cost of associating face with t, lower is better.
+func (t *track) cost(face *pb.FaceAnnotation) float64 {
+	return (1-boxIoU(t.box, faceBox(face)))*0.5 + t.landmarkDistance(face)*0.5
+}
+
+// observe folds a new detection into the track.
+func (t *track) observe(face *pb.FaceAnnotation, alpha float64) {
+	mix := func(old, cur float64) float64 {
+		return old*(1-alpha) + cur*alpha
+	}
+	box := faceBox(face)
+	for i := range t.box {
+		t.box[i] = mix(t.box[i], box[i])
+	}
+	t.roll = mix(t.roll, float64(face.RollAngle))
+	t.pan = mix(t.pan, float64(face.PanAngle))
+	t.tilt = mix(t.tilt, float64(face.TiltAngle))
+	for _, lm := range face.Landmarks {
+		if lm.Position == nil {
+			continue
+		}
+		p := [2]float64{float64(lm.Position.X), float64(lm.Position.Y)}
+		if old, ok := t.landmarks[lm.Type]; ok {
+			p = [2]float64{mix(old[0], p[0]), mix(old[1], p[1])}
+		}
+		t.landmarks[lm.Type] = p
+	}
+	t.last = proto.Clone(face).(*pb.FaceAnnotation)
+	t.missed = 0
+	t.apply()
+}
+
+// apply writes the smoothed state into the track's annotation.
+func (t *track) apply() {
+	poly := &pb.BoundingPoly{Vertices: []*pb.Vertex{
+		{X: int32(t.box[0] + 0.5), Y: int32(t.box[1] + 0.5)},
+		{X: int32(t.box[2] + 0.5), Y: int32(t.box[1] + 0.5)},
+		{X: int32(t.box[2] + 0.5), Y: int32(t.box[3] + 0.5)},
+		{X: int32(t.box[0] + 0.5), Y: int32(t.box[3] + 0.5)},
+	}}
+	t.last.BoundingPoly = poly
+	t.last.RollAngle = float32(t.roll)
+	t.last.PanAngle = float32(t.pan)
+	t.last.TiltAngle = float32(t.tilt)
+	for _, lm := range t.last.Landmarks {
+		if p, ok := t.landmarks[lm.Type]; ok && lm.Position != nil {
+			lm.Position.X, lm.Position.Y = float32(p[0]), float32(p[1])
+		}
+	}
+}
+
+// update matches the detections of a new frame to the existing tracks and
+// starts tracks for new faces. Tracks it misses start aging, see tick.
+func (tr *tracker) update(faces []*pb.FaceAnnotation) {
+	type pair struct {
+		t, f int
+		cost float64
+	}
+	var pairs []pair
+	for i, t := range tr.tracks {
+		for j, f := range faces {
+			// Too far apart to be the same person.
+			if c := t.cost(f); c < 0.75 {
+				pairs = append(pairs, pair{i, j, c})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].cost < pairs[j].cost })
+
+	trackUsed := make([]bool, len(tr.tracks))
+	faceUsed := make([]bool, len(faces))
+	for _, p := range pairs {
+		if trackUsed[p.t] || faceUsed[p.f] {
+			continue
+		}
+		trackUsed[p.t], faceUsed[p.f] = true, true
+		tr.tracks[p.t].observe(faces[p.f], tr.smoothing)
+	}
+
+	for i, t := range tr.tracks {
+		if !trackUsed[i] && t.missed == 0 {
+			t.missed = 1
+		}
+	}
+
+	for j, f := range faces {
+		if faceUsed[j] {
+			continue
+		}
+		t := &track{
+			face:      tr.perm[tr.next%len(tr.perm)],
+			landmarks: map[pb.FaceAnnotation_Landmark_Type][2]float64{},
+			box:       faceBox(f),
+			roll:      float64(f.RollAngle),
+			pan:       float64(f.PanAngle),
+			tilt:      float64(f.TiltAngle),
+		}
+		tr.next++
+		t.observe(f, 1)
+		tr.tracks = append(tr.tracks, t)
+	}
+}
+
+// tick advances the tracker by one frame, whether or not detection ran on
+// it. Missed tracks age and are dropped once gone for more than maxMissed
+// frames.
+func (tr *tracker) tick() {
+	kept := tr.tracks[:0]
+	for _, t := range tr.tracks {
+		if t.missed > 0 {
+			t.missed++
+		}
+		if t.missed <= tr.maxMissed {
+			kept = append(kept, t)
+		}
+	}
+	tr.tracks = kept
+}
+
+// faces returns the current smoothed faces and the library face assigned
+// to each. Tracks missed for a few frames keep their last position so a
+// single failed detection does not make a face flicker.
+func (tr *tracker) faces() ([]*pb.FaceAnnotation, []int) {
+	faces := make([]*pb.FaceAnnotation, 0, len(tr.tracks))
+	assign := make([]int, 0, len(tr.tracks))
+	for _, t := range tr.tracks {
+		faces = append(faces, t.last)
+		assign = append(assign, t.face)
+	}
+	return faces, assign
+}
@@ -1,27 +1,88 @@
 package main
 
 import (
+	"bytes"
 	"image"
 	"image/draw"
+	"io/ioutil"
 	"log"
-	"os"
+	"strings"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
-func loadImage(file string) image.Image {
-	reader, err := os.Open(file)
+// loadImage reads file, exiting if it cannot be read.
+func loadImage(file string) []byte {
+	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		log.Fatalf("error loading %s: %s", file, err)
 	}
-	img, _, err := image.Decode(reader)
+	return data
+}
+
+// decodeImage decodes an image file and turns it upright according to its
+// EXIF orientation, which is returned alongside the file's metadata.
+func decodeImage(data []byte) (image.Image, orientation, metadata, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		log.Fatalf("error loading %s: %s", file, err)
+		return nil, 0, metadata{}, err
+	}
+	o := orientation(fileOrientation(data))
+	m := readMetadata(data)
+	if o.swapsAxes() {
+		m.dpiX, m.dpiY = m.dpiY, m.dpiX
 	}
-	return img
+	return o.apply(img), o, m, nil
 }
 
-func canvasFromImage(i image.Image) *image.RGBA {
+// imageFlags are the flags that describe a single rendered image, which
+// animations, documents, streams and the sheet, mosaic and reverse
+// subcommands do not have.
+var imageFlags = []string{"assign", "compare", "debug-overlay", "export-layers", "mask-out", "recipe"}
+
+// rejectImageFlags exits if any of imageFlags but allowed was given on
+// the command line for input.
+func rejectImageFlags(given map[string]bool, input string, allowed ...string) {
+	skip := map[string]bool{}
+	for _, name := range allowed {
+		skip[name] = true
+	}
+	for _, name := range imageFlags {
+		if given[name] && !skip[name] {
+			log.Fatalf("--%s is not supported for %s", name, input)
+		}
+	}
+}
+
+// rejectLostMetadata exits if the output format cannot hold m, the
+// metadata of input that is to be kept.
+func rejectLostMetadata(format string, m *metadata, input string) {
+	if m == nil {
+		return
+	}
+	if lost := lostMetadata(format, *m); len(lost) > 0 {
+		log.Fatalf("%s output cannot hold the %s of %s, pass --strip-metadata all to drop it", format, strings.Join(lost, " and "), input)
+	}
+}
+
+// canvasImage is a drawable image that regions can be cut from.
+type canvasImage interface {
+	draw.Image
+	SubImage(r image.Rectangle) image.Image
+}
+
+// canvasFromImage copies i into a new canvas. Images with more than 8 bits
+// per channel get a 16-bit canvas so their precision survives.
+func canvasFromImage(i image.Image) canvasImage {
 	bounds := i.Bounds()
-	canvas := image.NewRGBA(bounds)
+	var canvas canvasImage
+	if isDeep(i) {
+		canvas = image.NewRGBA64(bounds)
+	} else {
+		canvas = image.NewRGBA(bounds)
+	}
 	draw.Draw(canvas, bounds, i, bounds.Min, draw.Src)
 
 	return canvas
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/vision/apiv1"
+	"golang.org/x/net/context"
+)
+
+// y4mHeader is the stream header of a YUV4MPEG2 stream.
+type y4mHeader struct {
+	width, height int
+	ratio         image.YCbCrSubsampleRatio
+	// fullRange is set for streams tagged XCOLORRANGE=FULL, others use
+	// the limited 16-235 video range.
+	fullRange bool
+	// params holds the header parameters in their original order so the
+	// output stream can repeat them.
+	params []string
+}
+
+// readY4MHeader parses the stream header of a YUV4MPEG2 stream.
+func readY4MHeader(r *bufio.Reader) (y4mHeader, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return y4mHeader{}, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "YUV4MPEG2" {
+		return y4mHeader{}, fmt.Errorf("not a YUV4MPEG2 stream")
+	}
+	h := y4mHeader{ratio: image.YCbCrSubsampleRatio420, params: fields[1:]}
+	for _, f := range h.params {
+		switch f[0] {
+		case 'W':
+			h.width, err = strconv.Atoi(f[1:])
+		case 'H':
+			h.height, err = strconv.Atoi(f[1:])
+		case 'C':
+			switch f[1:] {
+			case "420", "420jpeg", "420paldv", "420mpeg2":
+				h.ratio = image.YCbCrSubsampleRatio420
+			case "444":
+				h.ratio = image.YCbCrSubsampleRatio444
+			default:
+				err = fmt.Errorf("unsupported YUV4MPEG2 colorspace %s, only 4:2:0 and 4:4:4 are supported", f[1:])
+			}
+		case 'X':
+			if f == "XCOLORRANGE=FULL" {
+				h.fullRange = true
+			}
+		}
+		if err != nil {
+			return h, err
+		}
+	}
+	if h.width <= 0 || h.height <= 0 {
+		return h, fmt.Errorf("YUV4MPEG2 stream has no frame size")
+	}
+	return h, nil
+}
+
+func (h y4mHeader) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "YUV4MPEG2 %s\n", strings.Join(h.params, " "))
+	return err
+}
+
+// newFrame allocates a frame buffer for the stream.
+func (h y4mHeader) newFrame() *image.YCbCr {
+	return image.NewYCbCr(image.Rect(0, 0, h.width, h.height), h.ratio)
+}
+
+// readY4MFrame reads the next frame into frame. It returns io.EOF at the
+// end of the stream.
+func readY4MFrame(r *bufio.Reader, frame *image.YCbCr) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line == "" {
+			return io.EOF
+		}
+		return err
+	}
+	if !strings.HasPrefix(line, "FRAME") {
+		return fmt.Errorf("bad YUV4MPEG2 frame header %q", strings.TrimSpace(line))
+	}
+	for _, plane := range [][]byte{frame.Y, frame.Cb, frame.Cr} {
+		if _, err := io.ReadFull(r, plane); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func writeY4MFrame(w io.Writer, frame *image.YCbCr) error {
+	if _, err := io.WriteString(w, "FRAME\n"); err != nil {
+		return err
+	}
+	for _, plane := range [][]byte{frame.Y, frame.Cb, frame.Cr} {
+		if _, err := w.Write(plane); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func clampByte(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// yuvToRGBA converts a frame to RGB with BT.601 coefficients.
+func yuvToRGBA(src *image.YCbCr, fullRange bool, dst *image.RGBA) {
+	b := src.Rect
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			yy := float64(src.Y[src.YOffset(x, y)])
+			ci := src.COffset(x, y)
+			cb, cr := float64(src.Cb[ci])-128, float64(src.Cr[ci])-128
+			if !fullRange {
+				yy = (yy - 16) * 255 / 219
+				cb *= 255.0 / 224
+				cr *= 255.0 / 224
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = clampByte(yy + 1.402*cr)
+			dst.Pix[i+1] = clampByte(yy - 0.344136*cb - 0.714136*cr)
+			dst.Pix[i+2] = clampByte(yy + 1.772*cb)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+}
+
+// rgbaToYUV converts an RGB image into a frame, averaging the chroma of
+// the pixels that share a chroma sample.
+func rgbaToYUV(src *image.RGBA, fullRange bool, dst *image.YCbCr) {
+	b := dst.Rect
+	cw, ch := b.Dx(), b.Dy()
+	if dst.SubsampleRatio == image.YCbCrSubsampleRatio420 {
+		cw, ch = (cw+1)/2, (ch+1)/2
+	}
+	cbSum := make([]float64, cw*ch)
+	crSum := make([]float64, cw*ch)
+	count := make([]float64, cw*ch)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := src.PixOffset(x, y)
+			r, g, bl := float64(src.Pix[i]), float64(src.Pix[i+1]), float64(src.Pix[i+2])
+			yy := 0.299*r + 0.587*g + 0.114*bl
+			cb := -0.168736*r - 0.331264*g + 0.5*bl
+			cr := 0.5*r - 0.418688*g - 0.081312*bl
+			if !fullRange {
+				yy = yy*219/255 + 16
+				cb *= 224.0 / 255
+				cr *= 224.0 / 255
+			}
+			dst.Y[dst.YOffset(x, y)] = clampByte(yy)
+
+			cx, cy := x-b.Min.X, y-b.Min.Y
+			if dst.SubsampleRatio == image.YCbCrSubsampleRatio420 {
+				cx, cy = cx/2, cy/2
+			}
+			ci := cy*cw + cx
+			cbSum[ci] += cb
+			crSum[ci] += cr
+			count[ci]++
+		}
+	}
+	for cy := 0; cy < ch; cy++ {
+		for cx := 0; cx < cw; cx++ {
+			ci := cy*cw + cx
+			o := cy*dst.CStride + cx
+			dst.Cb[o] = clampByte(cbSum[ci]/count[ci] + 128)
+			dst.Cr[o] = clampByte(crSum[ci]/count[ci] + 128)
+		}
+	}
+}
+
+// chrisifyY4M streams a YUV4MPEG2 video from r to w, replacing faces in
+// every frame. Only one frame is held in memory at a time. Detection runs
+// on every nth frame and faces are tracked in between.
+func chrisifyY4M(ctx context.Context, client *vision.ImageAnnotatorClient, r io.Reader, w io.Writer, library FaceList, opts renderOptions, every int, smoothing float64) error {
+	if every < 1 {
+		every = 1
+	}
+	br := bufio.NewReaderSize(r, 1<<20)
+	bw := bufio.NewWriterSize(w, 1<<20)
+	h, err := readY4MHeader(br)
+	if err != nil {
+		return err
+	}
+	if err := h.write(bw); err != nil {
+		return err
+	}
+
+	frame := h.newFrame()
+	rgba := image.NewRGBA(frame.Rect)
+	tr := newTracker(library, smoothing)
+	for i := 0; ; i++ {
+		if err := readY4MFrame(br, frame); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		yuvToRGBA(frame, h.fullRange, rgba)
+
+		if i%every == 0 {
+			faces, err := detectImage(ctx, client, rgba)
+			if err != nil {
+				return err
+			}
+			tr.update(suppressDuplicates(faces, opts.nms))
+		}
+		faces, assign := tr.faces()
+		if len(faces) > 0 {
+			out := render(rgba, faces, library, assign, opts)
+			draw.Draw(rgba, rgba.Rect, out, out.Bounds().Min, draw.Src)
+			rgbaToYUV(rgba, h.fullRange, frame)
+		}
+		if err := writeY4MFrame(bw, frame); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}